@@ -0,0 +1,158 @@
+// Copyright (c) 2016 Hong Xiaodong. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+// cache_bench drives a util.Cache from several goroutines with a
+// configurable key space, value size, read/write mix and key skew, and
+// reports throughput and hit rate.  Use it to compare eviction policies
+// and locking changes:
+//
+//   cache_bench -cache_type=lru -threads=8 -zipf_s=1.1
+//   cache_bench -cache_type=clock -threads=8 -zipf_s=1.1
+
+package main
+
+import (
+  "encoding/binary"
+  "flag"
+  "fmt"
+  "math/rand"
+  "os"
+  "sync"
+  "time"
+
+  "github.com/hongxdong/go-leveldb/util"
+)
+
+var (
+  cache_type      = flag.String("cache_type", "lru", "Cache implementation: lru or clock.")
+  cache_size      = flag.Uint64("cache_size", 64 << 20, "Cache capacity in bytes.")
+  protected_ratio = flag.Float64("protected_ratio", 0, "Protected segment ratio of the lru cache.")
+  num_keys        = flag.Int("num_keys", 1 << 20, "Number of distinct keys.")
+  value_size      = flag.Int("value_size", 4096, "Size of each value, used as its charge.")
+  read_percent    = flag.Int("read_percent", 90, "Percentage of operations that are lookups; the rest are inserts.")
+  zipf_s          = flag.Float64("zipf_s", 0, "Zipf skew of the key distribution (> 1), or 0 for uniform.")
+  threads         = flag.Int("threads", 4, "Number of goroutines issuing operations.")
+  ops_per_thread  = flag.Int("ops_per_thread", 1000000, "Operations issued by each goroutine.")
+  populate        = flag.Bool("populate", true, "Fill the cache before measuring.")
+)
+
+// Per-goroutine counters, merged after the run.
+type benchStats struct {
+  lookups uint64
+  hits    uint64
+  inserts uint64
+}
+
+func newCache() util.Cache {
+  switch *cache_type {
+  case "lru":
+    var options util.LRUCacheOptions
+    options.Capacity = *cache_size
+    options.ProtectedRatio = *protected_ratio
+    return util.NewLRUCacheWithOptions(options)
+  case "clock":
+    return util.NewClockCache(*cache_size)
+  }
+  fmt.Fprintf(os.Stderr, "unknown -cache_type %q\n", *cache_type)
+  os.Exit(1)
+  return nil
+}
+
+// Encode "k" into "buf" in place.  Callers keep one Slice over "buf" for
+// all their keys, so that issuing an operation allocates nothing.
+func encodeKey(buf []byte, k uint64) {
+  binary.BigEndian.PutUint64(buf, k)
+}
+
+func deleter(key *util.Slice, value interface{}) {
+}
+
+// Issue "ops" operations against "cache", drawing keys from the
+// configured distribution.  The counters are kept in locals and stored in
+// "stats" once at the end, so goroutines do not share cache lines.
+func run(cache util.Cache, value []byte, seed int64, ops int, stats *benchStats) {
+  var r *rand.Rand = rand.New(rand.NewSource(seed))
+  var next_key func() uint64 = func() uint64 {
+    return uint64(r.Intn(*num_keys))
+  }
+  if *zipf_s > 1 {
+    var zipf *rand.Zipf = rand.NewZipf(r, *zipf_s, 1, uint64(*num_keys - 1))
+    next_key = zipf.Uint64
+  }
+
+  var buf []byte = make([]byte, 8)
+  var key *util.Slice = util.NewSlice(buf)
+  var charge uint64 = uint64(len(value))
+  var local benchStats
+  for i := 0; i < ops; i++ {
+    encodeKey(buf, next_key())
+    if r.Intn(100) < *read_percent {
+      local.lookups++
+      var h util.CacheHandle = cache.Lookup(key)
+      if h != nil {
+        local.hits++
+        cache.Release(h)
+      }
+    } else {
+      local.inserts++
+      cache.Release(cache.Insert(key, value, charge, deleter))
+    }
+  }
+  *stats = local
+}
+
+func main() {
+  flag.Parse()
+  if *num_keys <= 0 || *threads <= 0 || *value_size <= 0 {
+    fmt.Fprintln(os.Stderr, "-num_keys, -threads and -value_size must be positive")
+    os.Exit(1)
+  }
+  if *zipf_s != 0 && *zipf_s <= 1 {
+    fmt.Fprintln(os.Stderr, "-zipf_s must be > 1, or 0 for uniform keys")
+    os.Exit(1)
+  }
+
+  var cache util.Cache = newCache()
+  var value []byte = make([]byte, *value_size)
+  if *populate {
+    var buf []byte = make([]byte, 8)
+    var key *util.Slice = util.NewSlice(buf)
+    for k := 0; k < *num_keys; k++ {
+      encodeKey(buf, uint64(k))
+      cache.Release(cache.Insert(key, value, uint64(len(value)), deleter))
+    }
+  }
+
+  var stats []benchStats = make([]benchStats, *threads)
+  var wg sync.WaitGroup
+  var start time.Time = time.Now()
+  for t := 0; t < *threads; t++ {
+    wg.Add(1)
+    go func(t int) {
+      defer wg.Done()
+      run(cache, value, int64(t + 1), *ops_per_thread, &stats[t])
+    }(t)
+  }
+  wg.Wait()
+  var elapsed time.Duration = time.Since(start)
+
+  var total benchStats
+  for _, s := range stats {
+    total.lookups += s.lookups
+    total.hits += s.hits
+    total.inserts += s.inserts
+  }
+  var ops uint64 = total.lookups + total.inserts
+  fmt.Printf("cache_type:   %s\n", *cache_type)
+  fmt.Printf("cache_size:   %d bytes\n", *cache_size)
+  fmt.Printf("keys:         %d x %d bytes (zipf_s %g)\n", *num_keys, *value_size, *zipf_s)
+  fmt.Printf("threads:      %d\n", *threads)
+  fmt.Printf("operations:   %d (%d lookups, %d inserts)\n", ops, total.lookups, total.inserts)
+  fmt.Printf("elapsed:      %v\n", elapsed)
+  fmt.Printf("throughput:   %.0f ops/sec\n", float64(ops) / elapsed.Seconds())
+  if total.lookups > 0 {
+    fmt.Printf("hit rate:     %.2f%%\n", 100 * float64(total.hits) / float64(total.lookups))
+  }
+  fmt.Printf("usage:        %d bytes\n", cache.TotalCharge())
+}
@@ -18,8 +18,18 @@
 package util
 
 import (
+  "bufio"
+  "bytes"
+  "encoding/binary"
+  "errors"
+  "fmt"
+  "io"
+  "math/bits"
+  "runtime/debug"
+  "sort"
   "sync"
-  //"fmt"
+  "sync/atomic"
+  "time"
 )
 
 // Create a new cache with a fixed size capacity.  This implementation
@@ -28,8 +38,181 @@ func NewLRUCache(capacity uint64) Cache {
   return ConstructShardedLRUCache(capacity)
 }
 
-// Opaque handle to an entry stored in the cache.
-type CacheHandle interface{}
+// Options to control the behavior of a LRU cache.
+type LRUCacheOptions struct {
+  // Capacity of the cache.
+  Capacity uint64
+
+  // Fraction of the capacity reserved for the protected segment of a
+  // segmented LRU (SLRU).  New entries start in the probationary segment
+  // and are promoted to the protected segment when they are looked up;
+  // when the protected segment is full its oldest entries are demoted back
+  // to probation instead of being evicted.  Eviction takes from probation
+  // first, so a large one-shot scan only churns the probationary segment
+  // and does not flush the hot working set.
+  //
+  // Must be in [0, 1).  Default: 0, a plain LRU cache.
+  ProtectedRatio float64
+
+  // Fraction of the capacity reserved for the high-priority pool, which
+  // holds the entries inserted with CachePriorityHigh.  They are evicted
+  // only after all low-priority entries that are not in use, however
+  // often those are looked up; when the pool is full its oldest entries
+  // are demoted to low priority instead of being evicted.  The pool only
+  // holds high-priority entries, so it costs nothing if there are none.
+  //
+  // Must be in [0, 1].  Default: 0, which selects
+  // kDefaultHighPriPoolRatio.
+  HighPriPoolRatio float64
+
+  // If true, the cache never lets usage exceed capacity, even when every
+  // entry is pinned by clients: TryInsert() fails with ErrCacheFull and
+  // Insert() returns a handle to an entry that is not cached.
+  // Default: false, inserts always succeed and may overshoot capacity.
+  StrictCapacityLimit bool
+
+  // If true, record the stack trace of every Lookup() and Insert() that
+  // returns a handle, so that handles that are never Released can be
+  // reported by OutstandingHandles() and by DestructLRUCache().  Capturing
+  // a stack trace is expensive; meant for tests and debugging only.
+  // Default: false.
+  DebugHandles bool
+
+  // Computes the charge of values inserted with AutoCharge that do not
+  // implement Sizer.  Default: nil, such inserts panic.
+  Sizer func(value interface{}) uint64
+
+  // If set, entries evicted to make room are compressed and kept in a
+  // second tier with these options, and lookups that miss fall through to
+  // it.  Default: nil, evicted entries are dropped.
+  CompressedTier *CompressedTierOptions
+}
+
+// Fraction of the capacity of an LRU cache given to its high-priority pool
+// unless LRUCacheOptions.HighPriPoolRatio says otherwise.
+const kDefaultHighPriPoolRatio = 0.5
+
+// Create a new cache configured by "options".
+func NewLRUCacheWithOptions(options LRUCacheOptions) Cache {
+  return ConstructShardedLRUCacheWithOptions(options)
+}
+
+// Statistics of a single shard of a sharded cache.
+type CacheShardStats struct {
+  Usage   uint64  // Combined charge of the entries in the shard.
+  Entries uint64  // Number of entries in the shard.
+  Hits    uint64  // Lookups that found an entry.
+  Misses  uint64  // Lookups that found no entry.
+}
+
+// Returned by TryInsert() when a cache with a strict capacity limit has no
+// room left because all entries are in use.
+var ErrCacheFull = errors.New("cache is full: all entries are in use")
+
+// Pass as the charge of an insert to have the cache compute it: values
+// implementing Sizer are charged Charge(), other values are charged by
+// LRUCacheOptions.Sizer.
+const AutoCharge uint64 = ^uint64(0)
+
+// Implemented by values that know their own charge, e.g. a block charged
+// by its size in bytes.
+type Sizer interface {
+  Charge() uint64
+}
+
+// Implemented by values that wrap the caller's value, e.g. the entries of
+// a TypedCache, so that AutoCharge is computed from the caller's value.
+type wrappedValue interface {
+  unwrap() interface{}
+}
+
+// Return the charge of "value" given the charge passed to an insert.
+func chargeFor(value interface{}, charge uint64, sizer func(value interface{}) uint64) uint64 {
+  if charge != AutoCharge {
+    return charge
+  }
+  if w, ok := value.(wrappedValue); ok {
+    value = w.unwrap()
+  }
+  if v, ok := value.(Sizer); ok {
+    return v.Charge()
+  }
+  if sizer == nil {
+    panic("chargeFor() error: AutoCharge needs a Sizer value or LRUCacheOptions.Sizer")
+  }
+  return sizer(value)
+}
+
+// A handle returned by the cache that has not been Released yet.  Only
+// tracked when LRUCacheOptions.DebugHandles is set.
+type OutstandingHandle struct {
+  Key   []byte  // Copy of the entry's key.
+  Stack string  // Stack trace of the call that returned the handle.
+}
+
+// Opaque handle to an entry stored in the cache.  Only the caches in this
+// package can create handles.  A handle must be released to the cache that
+// returned it; this is not checked.  Methods that find no entry return a
+// nil CacheHandle, which can be compared with nil directly.
+type CacheHandle interface {
+  // Return the value encapsulated in the handle.
+  // REQUIRES: handle must not have been released yet.
+  Value() interface{}
+
+  // Unexported, so no type outside this package can be a CacheHandle.
+  cacheHandle()
+}
+
+// Priority of a cache entry.  High-priority entries (e.g. index and
+// filter blocks) are evicted after low-priority ones, within the limits
+// described at InsertWithPriority().
+type CachePriority int
+
+const (
+  CachePriorityLow CachePriority = iota
+  CachePriorityHigh
+)
+
+// What a cache entry holds, e.g. which kind of table block.  The cache
+// keeps usage and hit statistics per role (see CacheStats.Roles), so one
+// can tell whether it is full of index blocks or data blocks when tuning
+// its size.
+type CacheEntryRole uint8
+
+const (
+  CacheEntryRoleOther CacheEntryRole = iota  // Anything not tagged.
+  CacheEntryRoleDataBlock
+  CacheEntryRoleIndexBlock
+  CacheEntryRoleFilterBlock
+
+  kNumCacheEntryRoles = iota
+)
+
+// Statistics of the entries of one CacheEntryRole.
+type CacheRoleStats struct {
+  Usage uint64  // Combined charge of the entries with the role.
+  Hits  uint64  // Lookups that found an entry with the role.
+}
+
+// Usage statistics of a cache.  Counters are cumulative since the cache
+// was created; Usage is a snapshot of the current combined charge.
+type CacheStats struct {
+  Hits      uint64  // Lookups that found an entry.
+  Misses    uint64  // Lookups that found no entry.
+  Inserts   uint64  // Calls to Insert().
+  Evictions uint64  // Entries dropped to keep usage within capacity.
+  Usage     uint64  // Combined charge of all elements stored in the cache.
+
+  Roles [kNumCacheEntryRoles]CacheRoleStats  // Indexed by CacheEntryRole.
+}
+
+// Add the per-role statistics of a shard to those of the whole cache.
+func addRoleStats(total *CacheStats, shard *CacheStats) {
+  for r := 0; r < kNumCacheEntryRoles; r++ {
+    total.Roles[r].Usage += shard.Roles[r].Usage
+    total.Roles[r].Hits += shard.Roles[r].Hits
+  }
+}
 
 type Cache interface {
   // Insert a mapping from key->value into the cache and assign it
@@ -41,15 +224,76 @@ type Cache interface {
   //
   // When the inserted entry is no longer needed, the key and
   // value will be passed to "deleter".
+  //
+  // Pass AutoCharge as the charge to have it computed from the value
+  // (see Sizer).
   Insert(key *Slice, value interface{}, charge uint64, deleter LRUHandleDeleter) CacheHandle
 
-  // If the cache has no mapping for "key", returns NULL.
+  // Same as Insert(), but the entry expires "ttl" after insertion.  An
+  // expired entry is treated as a miss by Lookup() and is removed from
+  // the cache at that point.  A ttl <= 0 means the entry never expires.
+  InsertWithTTL(key *Slice, value interface{}, charge uint64, ttl time.Duration,
+                deleter LRUHandleDeleter) CacheHandle
+
+  // Same as Insert(), but with an explicit priority.  In the LRU cache,
+  // high-priority entries go to a pool of their own, evicted only after
+  // the low-priority entries (see LRUCacheOptions.HighPriPoolRatio).
+  // In the CLOCK cache, high-priority entries start with their reference
+  // bit set, surviving one more sweep of the clock hand.
+  InsertWithPriority(key *Slice, value interface{}, charge uint64, priority CachePriority,
+                     deleter LRUHandleDeleter) CacheHandle
+
+  // Same as Insert(), but tags the entry with "role" for the per-role
+  // statistics in Stats().  Entries inserted otherwise are
+  // CacheEntryRoleOther.
+  InsertWithRole(key *Slice, value interface{}, charge uint64, role CacheEntryRole,
+                 deleter LRUHandleDeleter) CacheHandle
+
+  // Same as Insert(), but the cache keeps referring to key.data() instead
+  // of copying it, saving a copy per insert on hot paths.
+  // REQUIRES: the caller must not modify the key bytes for as long as the
+  // entry may be in the cache or referenced by a handle.
+  InsertOwnedKey(key *Slice, value interface{}, charge uint64, deleter LRUHandleDeleter) CacheHandle
+
+  // Same as Insert(), but if the cache has a strict capacity limit and
+  // cannot make room for "charge" because too many entries are in use,
+  // returns (nil, ErrCacheFull) without inserting.  The deleter is not
+  // called in that case; the caller still owns "value".
+  TryInsert(key *Slice, value interface{}, charge uint64, deleter LRUHandleDeleter) (CacheHandle, error)
+
+  // Turn the strict capacity limit on or off (see
+  // LRUCacheOptions.StrictCapacityLimit).  When it is on, Insert() of an
+  // entry that does not fit returns a handle to an uncached entry, as if
+  // the cache had no capacity.
+  SetStrictCapacityLimit(strict bool)
+
+  // If the cache has no mapping for "key", returns nil.
   //
   // Else return a handle that corresponds to the mapping.  The caller
   // must call this->Release(handle) when the returned mapping is no
   // longer needed.
   Lookup(key *Slice) CacheHandle
 
+  // Return a handle for "key".  If the cache has no mapping for "key",
+  // "loader" is called to produce the value, which is inserted with the
+  // given charge and deleter.  Concurrent callers missing on the same key
+  // wait for a single loader call instead of loading it in parallel.  If
+  // the loader fails, nothing is inserted and its error is returned to
+  // every caller waiting on it.
+  //
+  // The caller must call this->Release(handle) when the returned mapping
+  // is no longer needed.
+  GetOrInsert(key *Slice, charge uint64, loader func() (interface{}, error),
+              deleter LRUHandleDeleter) (CacheHandle, error)
+
+  // If the cache has a mapping for "key", return its value and true.
+  // Unlike Lookup(), the entry is neither pinned nor promoted, and no
+  // statistics are updated, so monitoring and prefetch heuristics can
+  // probe the cache without distorting eviction.  Since the entry is
+  // not pinned, it may be evicted (and passed to its deleter) at any time
+  // after Peek() returns.
+  Peek(key *Slice) (interface{}, bool)
+
   // Release a mapping returned by a previous Lookup().
   // REQUIRES: handle must not have been released yet.
   // REQUIRES: handle must have been returned by a method on *this.
@@ -66,6 +310,11 @@ type Cache interface {
   // to it have been released.
   Erase(key *Slice)
 
+  // Erase every entry whose key starts with "prefix", e.g. all blocks
+  // cached under one table's cache id.  As with Erase(), entries stay
+  // alive until all existing handles to them have been released.
+  ErasePrefix(prefix *Slice)
+
   // Return a new numeric id.  May be used by multiple clients who are
   // sharing the same cache to partition the key space.  Typically the
   // client will allocate a new id at startup and prepend the id to
@@ -79,10 +328,32 @@ type Cache interface {
   // leveldb may change Prune() to a pure abstract method.
   Prune()
 
+  // Remove entries that are not actively in use, least recently used
+  // first, until the combined charge is at most "target".  Entries still
+  // referenced by clients are kept, so the usage may stay above target.
+  // Memory-pressure handlers can use this to trim the cache instead of
+  // dropping everything with Prune().
+  PruneTo(target uint64)
+
   // Return an estimate of the combined charges of all elements stored in the
   // cache.
   TotalCharge() uint64
 
+  // Change the capacity of the cache at runtime.  When shrinking,
+  // entries not actively in use are evicted until the usage fits the new
+  // capacity; entries still referenced by clients are dropped once they
+  // are released and something else needs the room.
+  SetCapacity(capacity uint64)
+
+  // Return hit/miss/insert/eviction counters and the current usage.
+  Stats() CacheStats
+
+  // Call "fn" once for every entry currently stored in the cache, in no
+  // particular order.  Entries only referenced by clients after being
+  // erased are not visited.  Each shard is locked while its entries are
+  // visited, so "fn" must not call back into the cache.
+  ApplyToAllEntries(fn func(key *Slice, value interface{}, charge uint64))
+
   // LRU_Remove(e *CacheHandle)
   // LRU_Append(e *CacheHandle)
   // Unref(e *CacheHandle)
@@ -110,8 +381,44 @@ type Cache interface {
 // An entry is a variable length heap-allocated structure.  Entries
 // are kept in a circular doubly linked list ordered by access time.
 
+// Called with the key and value of an entry that is no longer needed.
+// The deleter may keep the key: the cache never reuses its storage.  For
+// InsertOwnedKey() it is the caller's own buffer.
 type LRUHandleDeleter func(*Slice, interface{})
 
+// Why an entry was removed from the cache.
+type EvictionReason int
+
+const (
+  EvictionCapacity EvictionReason = iota  // Dropped to make room.
+  EvictionErase                           // Removed by Erase().
+  EvictionPrune                           // Removed by Prune().
+  EvictionReplace                         // Replaced by an Insert() of the same key.
+  EvictionExpired                         // Its TTL passed.
+)
+
+func (r EvictionReason) String() string {
+  switch r {
+  case EvictionCapacity:
+    return "capacity"
+  case EvictionErase:
+    return "erase"
+  case EvictionPrune:
+    return "prune"
+  case EvictionReplace:
+    return "replace"
+  case EvictionExpired:
+    return "expired"
+  }
+  return "unknown"
+}
+
+// Called when an entry is removed from the cache, with the reason.  Unlike
+// the per-entry deleter, it runs when the cache drops its own reference,
+// even if clients still hold handles to the entry.  It is called with the
+// shard locked, so it must be quick and must not call back into the cache.
+type EvictionListener func(key *Slice, value interface{}, reason EvictionReason)
+
 type LRUHandle struct {
   value      interface{}
   deleter    LRUHandleDeleter
@@ -121,11 +428,56 @@ type LRUHandle struct {
   charge     uint64      // TODO(opt): Only allow uint32_t?
   key_length uint64
   in_cache   bool        // Whether entry is in the cache.
+  protected  bool        // Whether entry is in the protected segment (SLRU only).
+  high_pri   bool        // Whether entry is in the high-priority pool (LRUCache only).
   refs       uint32      // References, including cache reference, if present.
   hash       uint32      // Hash of key(); used for fast sharding and comparisons
+  expire_at  int64       // UnixNano after which the entry is stale; 0 means never.
+  visited    uint32      // CLOCK reference bit; only used by ClockCache.
+  pinned     bool        // Whether entry is on the in_use_ list (LRUCache only).
+  spill_stale bool       // Key was written while the entry was being spilled.
+  role       CacheEntryRole  // For the per-role statistics.
   key_data   []byte      // Beginning of key
 }
 
+// Freed handles, recycled by Insert() to reduce GC churn.  A handle is
+// put back once its refs drop to zero, so it must not be touched after
+// its last Release().
+var lru_handle_pool = sync.Pool{
+  New: func() interface{} {
+    return new(LRUHandle)
+  },
+}
+
+// Return a zeroed handle, reusing a freed one when possible.
+func NewLRUHandle() *LRUHandle {
+  var e *LRUHandle = lru_handle_pool.Get().(*LRUHandle)
+  *e = LRUHandle{}
+  return e
+}
+
+// Recycle a handle whose refs dropped to zero.  Its key buffer is not
+// reused, since the deleter may have kept the key it was passed.
+func FreeLRUHandle(e *LRUHandle) {
+  e.value = nil  // Don't keep the value, deleter and key alive while pooled.
+  e.deleter = nil
+  e.key_data = nil
+  e.next_hash = nil
+  e.next = nil
+  e.prev = nil
+  lru_handle_pool.Put(e)
+}
+
+func (lh *LRUHandle) Value() interface{} {
+  return lh.value
+}
+
+func (lh *LRUHandle) cacheHandle() {}
+
+func (lh *LRUHandle) expired() bool {
+  return lh.expire_at != 0 && time.Now().UnixNano() > lh.expire_at
+}
+
 
 func (lh *LRUHandle) key() *Slice {
   // For cheaper lookups, we allow a temporary Handle object
@@ -195,14 +547,39 @@ func (s *HandleTable) Remove(key *Slice, hash uint32) *LRUHandle {
 // Return a pointer to slot that points to a cache entry that
 // matches key/hash.  If there is no such cache entry, return a
 // pointer to the trailing slot in the corresponding linked list.
+//
+// The key_data of an entry in the table is immutable: it is either the
+// entry's own copy or, for InsertOwnedKey(), a buffer the caller promised
+// not to modify.  So compare against key_data directly instead of wrapping
+// it in a Slice; this keeps cache hits allocation-free.
 func (s *HandleTable) FindPointer(key *Slice, hash uint32) **LRUHandle {
   var ptr **LRUHandle = &s.list_[hash & (s.length_ - 1)]
-  for (*ptr != nil) && ((*ptr).hash != hash || key.NotEqual((*ptr).key())) {
+  for (*ptr != nil) && ((*ptr).hash != hash || !bytes.Equal(key.data(), (*ptr).key_data)) {
     ptr = &(*ptr).next_hash
   }
   return ptr
 }
 
+// Call "fn" for every entry in the table.
+func (s *HandleTable) ApplyToAll(fn func(h *LRUHandle)) {
+  for i := uint32(0); i < s.length_; i++ {
+    for h := s.list_[i]; h != nil; h = h.next_hash {
+      fn(h)
+    }
+  }
+}
+
+// Return the entries whose key starts with "prefix".
+func (s *HandleTable) MatchPrefix(prefix *Slice) []*LRUHandle {
+  var matches []*LRUHandle
+  s.ApplyToAll(func(h *LRUHandle) {
+    if bytes.HasPrefix(h.key_data, prefix.data()) {
+      matches = append(matches, h)
+    }
+  })
+  return matches
+}
+
 func (s *HandleTable) Resize() {
   var new_length = uint32(4)
   for new_length < s.elems_ {
@@ -229,21 +606,83 @@ func (s *HandleTable) Resize() {
   s.length_ = new_length
 }
 
+// Number of hits a shard logs between write locks; see LRUCache.hit_log_.
+const kHitLogSize = 64
+
 // A single shard of sharded cache.
 type LRUCache struct {
+  // Statistics, updated atomically so Stats() does not need mutex_.
+  // Kept first in the struct so they are 64-bit aligned.
+  hits_      uint64
+  misses_    uint64
+  inserts_   uint64
+  evictions_ uint64
+  role_hits_ [kNumCacheEntryRoles]uint64
+
   capacity_ uint64      // Initialized before use.
-  mutex_    sync.Mutex  // mutex_ protects the following state.
+  protected_ratio_    float64  // Initialized before use.
+  protected_capacity_ uint64   // capacity_ * protected_ratio_; 0 disables SLRU.
+  high_pri_ratio_     float64  // Initialized before use.
+  high_pri_capacity_  uint64   // capacity_ * high_pri_ratio_.
+
+  // mutex_ protects the following state.  Lookup() and Release() only
+  // take the read lock: they adjust refs atomically and leave the lists
+  // alone, logging hits in hit_log_ instead.  Whoever takes the write lock
+  // next applies the logged hits, in order, before anything else.
+  mutex_    sync.RWMutex
+
+  // Entries hit by read-locked Lookup() calls, oldest first.  Each logged
+  // entry holds a reference so it stays alive until the hit is applied.
+  // hit_count_ is bumped atomically to claim a slot; once it reaches
+  // kHitLogSize, lookups fall back to the write lock.
+  hit_log_   [kHitLogSize]atomic.Pointer[LRUHandle]
+  hit_count_ uint32
+
   usage_    uint64
+  protected_usage_ uint64  // Charge of entries with protected==true.
+  high_pri_usage_  uint64  // Charge of entries with high_pri==true.
+  role_usage_ [kNumCacheEntryRoles]uint64  // usage_ by CacheEntryRole.
 
   // Dummy head of LRU list.
   // lru.prev is newest entry, lru.next is oldest entry.
-  // Entries have refs==1 and in_cache==true.
+  // Entries have refs==1 and in_cache==true, except for those with hits
+  // still waiting in hit_log_.
+  // In SLRU mode this is the probationary segment: protected==false.
   lru_      LRUHandle  // circular doubly linked list ordered by access time.
 
+  // Dummy head of the protected segment (SLRU mode only).
+  // Ordered like lru_; entries have refs==1, in_cache==true and
+  // protected==true, with the same exception as lru_.
+  protected_ LRUHandle
+
+  // Dummy head of the high-priority pool.  Ordered like lru_; entries
+  // have refs==1, in_cache==true and high_pri==true, with the same
+  // exception as lru_.
+  high_pri_  LRUHandle
+
   // Dummy head of in-use list.
-  // Entries are in use by clients, and have refs >= 2 and in_cache==true.
+  // Entries are in use by clients, and have refs >= 2, in_cache==true
+  // and pinned==true.
   in_use_   LRUHandle
   table_    HandleTable
+
+  strict_capacity_limit_ bool
+
+  on_evict_ EvictionListener  // May be nil.
+  sizer_    func(value interface{}) uint64  // May be nil.
+
+  // Called with entries evicted for capacity; may be nil.  See SetSpill().
+  spill_    func(key *Slice, value interface{}, charge uint64, role CacheEntryRole) func()
+
+  // Entries evicted for capacity whose spill_ has not finished, and the
+  // ones among them not yet handed to spill_.  Each holds a reference so
+  // its deleter does not run before spill_ has seen it.
+  spilling_ []*LRUHandle
+  spilled_  []*LRUHandle
+
+  // Stack traces of the handles returned to clients and not yet released,
+  // most recent last.  nil unless debugging handles.
+  handle_stacks_ map[*LRUHandle][]string
 }
 
 func ConstructLRUCache() *LRUCache {
@@ -254,41 +693,196 @@ func ConstructLRUCache() *LRUCache {
   ret.lru_.prev = &ret.lru_
   ret.in_use_.next = &ret.in_use_
   ret.in_use_.prev = &ret.in_use_
+  ret.protected_.next = &ret.protected_
+  ret.protected_.prev = &ret.protected_
+  ret.high_pri_.next = &ret.high_pri_
+  ret.high_pri_.prev = &ret.high_pri_
   ret.table_ = ConstructHandleTable()
   return ret
 }
 
 func (s *LRUCache) DestructLRUCache() {
+  s.ApplyHits()
   if (s.in_use_.next != &s.in_use_) {   // Error if caller has an unreleased handle
+    if s.handle_stacks_ != nil {
+      panic("DestructLRUCache() error: unreleased handles\n" +
+            FormatOutstandingHandles(s.OutstandingHandles()))
+    }
     panic("DestructLRUCache() error")
   }
 
-  for e := s.lru_.next; e != &s.lru_; {
-    var next *LRUHandle = e.next
-    if !e.in_cache {
-      panic("DestructLRUCache() error")
-    }
-    e.in_cache = false
-    if e.refs != 1 {    // Invariant of lru_ list.
-      panic("DestructLRUCache() error")
+  for _, list := range []*LRUHandle{&s.lru_, &s.protected_, &s.high_pri_} {
+    for e := list.next; e != list; {
+      var next *LRUHandle = e.next
+      if !e.in_cache {
+        panic("DestructLRUCache() error")
+      }
+      e.in_cache = false
+      if e.refs != 1 {    // Invariant of lru_, protected_ and high_pri_ lists.
+        panic("DestructLRUCache() error")
+      }
+      s.Unref(e)
+      e = next
     }
-    s.Unref(e)
-    e = next
   }
 }
 
 func (s *LRUCache) SetCapacity(capacity uint64) {
+  s.Lock()
   s.capacity_ = capacity
+  s.protected_capacity_ = uint64(float64(capacity) * s.protected_ratio_)
+  s.high_pri_capacity_ = uint64(float64(capacity) * s.high_pri_ratio_)
+  s.DemoteProtected()
+  s.DemoteHighPri()
+  s.EvictToCapacity()
+  s.Unlock()
+}
+
+// Set the fraction of capacity used by the protected segment.  A ratio
+// of 0 turns the shard into a plain LRU cache.
+func (s *LRUCache) SetProtectedRatio(ratio float64) {
+  if ratio < 0 || ratio >= 1 {
+    panic("SetProtectedRatio() error")
+  }
+  s.Lock()
+  s.protected_ratio_ = ratio
+  s.protected_capacity_ = uint64(float64(s.capacity_) * s.protected_ratio_)
+  s.DemoteProtected()
+  s.EvictToCapacity()
+  s.Unlock()
+}
+
+// Set the fraction of capacity used by the high-priority pool.  A ratio
+// of 0 treats every entry as low priority.
+func (s *LRUCache) SetHighPriPoolRatio(ratio float64) {
+  if ratio < 0 || ratio > 1 {
+    panic("SetHighPriPoolRatio() error")
+  }
+  s.Lock()
+  s.high_pri_ratio_ = ratio
+  s.high_pri_capacity_ = uint64(float64(s.capacity_) * s.high_pri_ratio_)
+  s.DemoteHighPri()
+  s.EvictToCapacity()
+  s.Unlock()
+}
+
+func (s *LRUCache) SetStrictCapacityLimit(strict bool) {
+  s.Lock()
+  s.strict_capacity_limit_ = strict
+  s.Unlock()
+}
+
+func (s *LRUCache) SetEvictionListener(listener EvictionListener) {
+  s.Lock()
+  s.on_evict_ = listener
+  s.Unlock()
+}
+
+// Set the function given the entries evicted to make room, e.g. to keep
+// them in a second tier.  Entries with a TTL are not passed on.  "spill"
+// runs without the lock held and before the entry's deleter; the function
+// it returns, if not nil, runs with the lock held and stores the result,
+// and is skipped if the key was written since the eviction.
+func (s *LRUCache) SetSpill(spill func(key *Slice, value interface{}, charge uint64,
+                                      role CacheEntryRole) func()) {
+  s.Lock()
+  s.spill_ = spill
+  s.Unlock()
+}
+
+// Set the function that charges AutoCharge inserts of values that do not
+// implement Sizer.
+func (s *LRUCache) SetSizer(sizer func(value interface{}) uint64) {
+  s.Lock()
+  s.sizer_ = sizer
+  s.Unlock()
 }
 
 func (s *LRUCache) Ref(e *LRUHandle) {
-  if e.refs == 1 && e.in_cache {    // If on lru_ list, move to in_use_ list.
-    s.LRU_Remove(e)
-    s.LRU_Append(&s.in_use_, e)
+  if e.in_cache && !e.pinned {    // If on lru_ list, move to in_use_ list.
+    s.Pin(e)
   }
   e.refs++
 }
 
+// Take the write lock and apply the hits logged by read-locked lookups.
+func (s *LRUCache) Lock() {
+  s.mutex_.Lock()
+  s.ApplyHits()
+}
+
+// Release the write lock, then pass the entries evicted under it to
+// spill_.  spill_ (e.g. compressing) runs unlocked so it does not hold up
+// the shard; what it returns runs under the lock again, unless the key
+// was inserted or erased in the meantime.
+func (s *LRUCache) Unlock() {
+  var spilled []*LRUHandle = s.spilled_
+  var spill func(key *Slice, value interface{}, charge uint64, role CacheEntryRole) func() = s.spill_
+  s.spilled_ = nil
+  s.mutex_.Unlock()
+  if len(spilled) == 0 {
+    return
+  }
+
+  var finish []func() = make([]func(), len(spilled))
+  for i, e := range spilled {
+    finish[i] = spill(e.key(), e.value, e.charge, e.role)
+  }
+  s.mutex_.Lock()
+  for i, e := range spilled {
+    if finish[i] != nil && !e.spill_stale {
+      finish[i]()
+    }
+    for j, f := range s.spilling_ {
+      if f == e {
+        s.spilling_ = append(s.spilling_[:j], s.spilling_[j + 1:] ...)
+        break
+      }
+    }
+    s.Unref(e)
+  }
+  s.mutex_.Unlock()
+}
+
+// Mark the entries being spilled under "key" as stale, since the key is
+// being written.  Requires mutex_ held.
+func (s *LRUCache) StaleSpills(key *Slice, hash uint32) {
+  for _, e := range s.spilling_ {
+    if e.hash == hash && key.Equal(e.key()) {
+      e.spill_stale = true
+    }
+  }
+}
+
+// Apply the logged hits in the order they happened, as Lookup() would
+// have under the write lock, and drop the references they held.
+// Requires mutex_ held.
+func (s *LRUCache) ApplyHits() {
+  var n uint32 = atomic.LoadUint32(&s.hit_count_)
+  if n > kHitLogSize {
+    n = kHitLogSize
+  }
+  for i := uint32(0); i < n; i++ {
+    var e *LRUHandle = s.hit_log_[i].Swap(nil)
+    if e.in_cache {
+      if !e.pinned && e.refs > 2 {  // Still held by a client.
+        s.Pin(e)
+      }
+      s.Protect(e)
+    }
+    s.Unref(e)  // Moves e to the newest end once no client holds it.
+  }
+  atomic.StoreUint32(&s.hit_count_, 0)
+}
+
+// Move an entry in use by clients to the in_use_ list.  Requires mutex_
+// held.
+func (s *LRUCache) Pin(e *LRUHandle) {
+  s.LRU_Remove(e)
+  s.LRU_Append(&s.in_use_, e)
+  e.pinned = true
+}
+
 func (s *LRUCache) Unref(e *LRUHandle) {
   if e.refs <= 0 {
     panic("Unref() error")
@@ -300,11 +894,58 @@ func (s *LRUCache) Unref(e *LRUHandle) {
     }
     e.deleter(e.key(), e.value)
     // fmt.Printf("deleter(%v, %T)\n", e, e)
-    // free(e);
+    FreeLRUHandle(e)
   } else if e.in_cache && e.refs == 1 {   // No longer in use; move to lru_ list.
     // fmt.Printf("lru_(%v, %T)\n", e, e)
     s.LRU_Remove(e)
-    s.LRU_Append(&s.lru_, e)
+    e.pinned = false
+    if e.high_pri {
+      s.LRU_Append(&s.high_pri_, e)
+      s.DemoteHighPri()
+    } else if e.protected {
+      s.LRU_Append(&s.protected_, e)
+      s.DemoteProtected()
+    } else {
+      s.LRU_Append(&s.lru_, e)
+    }
+  }
+}
+
+// Mark a looked-up entry as protected (SLRU mode only).  The entry moves
+// to the protected_ list when its last client reference is released.
+// High-priority entries stay in their pool.  Requires mutex_ held.
+func (s *LRUCache) Protect(e *LRUHandle) {
+  if s.protected_capacity_ > 0 && !e.protected && !e.high_pri {
+    e.protected = true
+    s.protected_usage_ += e.charge
+    s.DemoteProtected()
+  }
+}
+
+// Move the oldest protected entries back to the newest end of probation
+// until the protected segment fits its capacity.  Entries that are in use
+// stay protected until they are released.  Requires mutex_ held.
+func (s *LRUCache) DemoteProtected() {
+  for s.protected_usage_ > s.protected_capacity_ && s.protected_.next != &s.protected_ {
+    var old *LRUHandle = s.protected_.next
+    s.LRU_Remove(old)
+    old.protected = false
+    s.protected_usage_ -= old.charge
+    s.LRU_Append(&s.lru_, old)
+  }
+}
+
+// Move the oldest entries of the high-priority pool to the newest end of
+// lru_, as low-priority entries, until the pool fits its capacity.
+// Entries that are in use stay in the pool until they are released.
+// Requires mutex_ held.
+func (s *LRUCache) DemoteHighPri() {
+  for s.high_pri_usage_ > s.high_pri_capacity_ && s.high_pri_.next != &s.high_pri_ {
+    var old *LRUHandle = s.high_pri_.next
+    s.LRU_Remove(old)
+    old.high_pri = false
+    s.high_pri_usage_ -= old.charge
+    s.LRU_Append(&s.lru_, old)
   }
 }
 
@@ -322,108 +963,545 @@ func (s *LRUCache) LRU_Append(list *LRUHandle, e *LRUHandle) {
 }
 
 func (s *LRUCache) Lookup(key *Slice, hash uint32) CacheHandle {
-  s.mutex_.Lock()
+  s.mutex_.RLock()
   var e *LRUHandle = s.table_.Lookup(key, hash)
+  if e == nil {
+    s.mutex_.RUnlock()
+    atomic.AddUint64(&s.misses_, 1)
+    return nil
+  }
+  if !e.expired() && s.handle_stacks_ == nil {
+    var slot uint32 = atomic.AddUint32(&s.hit_count_, 1) - 1
+    if slot < kHitLogSize {
+      // The cache's own reference keeps e alive while we hold the read
+      // lock.  Take one for the caller and one for the log.
+      atomic.AddUint32(&e.refs, 2)
+      s.hit_log_[slot].Store(e)
+      s.mutex_.RUnlock()
+      atomic.AddUint64(&s.hits_, 1)
+      atomic.AddUint64(&s.role_hits_[e.role], 1)
+      return e
+    }
+  }
+  s.mutex_.RUnlock()
+
+  // Expired, hit log full, or handles are tracked: redo the lookup under
+  // the write lock.
+  s.Lock()
+  e = s.table_.Lookup(key, hash)
+  if e != nil && e.expired() {
+    // Drop the stale entry; holders of existing handles keep it alive
+    // until they release them.
+    s.FinishErase(s.table_.Remove(key, hash), EvictionExpired)
+    e = nil
+  }
   if e != nil {
     s.Ref(e)
+    s.Protect(e)
+    s.TrackHandle(e)
+    atomic.AddUint64(&s.hits_, 1)
+    atomic.AddUint64(&s.role_hits_[e.role], 1)
+  } else {
+    atomic.AddUint64(&s.misses_, 1)
+    s.Unlock()
+    return nil
   }
-  s.mutex_.Unlock()
+  s.Unlock()
   return e
 }
 
+func (s *LRUCache) Peek(key *Slice, hash uint32) (interface{}, bool) {
+  s.mutex_.RLock()
+  defer s.mutex_.RUnlock()
+  var e *LRUHandle = s.table_.Lookup(key, hash)
+  if e == nil || e.expired() {
+    return nil, false
+  }
+  return e.value, true
+}
+
 func (s *LRUCache) Release(handle CacheHandle) {
-  s.mutex_.Lock()
-  s.Unref(handle.(*LRUHandle))
-  s.mutex_.Unlock()
+  var e *LRUHandle = handle.(*LRUHandle)
+  s.mutex_.RLock()
+  if s.handle_stacks_ == nil {
+    for {
+      // Dropping a reference needs no list changes unless it is the last
+      // one besides the cache's and the entry sits on in_use_.  The read
+      // lock keeps in_cache and pinned from changing under us.
+      var refs uint32 = atomic.LoadUint32(&e.refs)
+      if refs < 2 || (refs == 2 && e.in_cache && e.pinned) {
+        break
+      }
+      if atomic.CompareAndSwapUint32(&e.refs, refs, refs - 1) {
+        s.mutex_.RUnlock()
+        return
+      }
+    }
+  }
+  s.mutex_.RUnlock()
+
+  s.Lock()
+  s.UntrackHandle(e)
+  s.Unref(e)
+  s.Unlock()
 }
 
 func (s *LRUCache) Insert(key *Slice, hash uint32, value interface{},
                           charge uint64, deleter LRUHandleDeleter) CacheHandle {
-  s.mutex_.Lock()
+  return s.InsertEntry(key, hash, value, charge, deleter, &insertOptions{})
+}
+
+func (s *LRUCache) InsertWithTTL(key *Slice, hash uint32, value interface{},
+                                 charge uint64, ttl time.Duration,
+                                 deleter LRUHandleDeleter) CacheHandle {
+  return s.InsertEntry(key, hash, value, charge, deleter, &insertOptions{ttl: ttl})
+}
+
+func (s *LRUCache) InsertEntry(key *Slice, hash uint32, value interface{},
+                               charge uint64, deleter LRUHandleDeleter,
+                               opts *insertOptions) CacheHandle {
+  var expire_at int64 = 0
+  if opts.ttl > 0 {
+    expire_at = time.Now().Add(opts.ttl).UnixNano()
+  }
+
+  s.Lock()
+  if opts.promote {
+    // The Lookup() that missed and led here is a hit after all.
+    atomic.AddUint64(&s.misses_, ^uint64(0))
+    var existing *LRUHandle = s.table_.Lookup(key, hash)
+    if existing != nil && !existing.expired() {
+      s.Ref(existing)
+      s.TrackHandle(existing)
+      atomic.AddUint64(&s.hits_, 1)
+      atomic.AddUint64(&s.role_hits_[existing.role], 1)
+      opts.cached = true
+      s.Unlock()
+      return existing
+    }
+    atomic.AddUint64(&s.hits_, 1)
+    atomic.AddUint64(&s.role_hits_[opts.role], 1)
+  } else {
+    atomic.AddUint64(&s.inserts_, 1)
+  }
+  charge = chargeFor(value, charge, s.sizer_)
 
-  var e *LRUHandle = new(LRUHandle)
+  var cache bool = s.capacity_ > 0
+  if cache && s.strict_capacity_limit_ && !s.MakeRoom(charge) {
+    if opts.fail_if_full {
+      s.Unlock()
+      return nil
+    }
+    cache = false
+  }
+
+  var e *LRUHandle = NewLRUHandle()
   e.value = value
   e.deleter = deleter
   e.charge = charge
   e.key_length = key.size()
   e.hash = hash
+  e.expire_at = expire_at
+  e.role = opts.role
   e.in_cache = false
   e.refs = 1  // for the returned handle.
-  e.key_data = append(e.key_data, key.data() ...)
+  if opts.owned_key {
+    e.key_data = key.data()
+  } else {
+    e.key_data = append(e.key_data, key.data() ...)
+  }
 
-  if s.capacity_ > 0 {
+  if cache {
+    if len(s.spilling_) > 0 {
+      s.StaleSpills(key, hash)
+    }
     e.refs++  // for the cache's reference.
     e.in_cache = true
+    e.pinned = true
     s.LRU_Append(&s.in_use_, e)
     s.usage_ += charge
-    s.FinishErase(s.table_.Insert(e))
+    s.role_usage_[e.role] += charge
+    s.FinishErase(s.table_.Insert(e), EvictionReplace)
+    if opts.priority == CachePriorityHigh && s.high_pri_capacity_ > 0 {
+      e.high_pri = true
+      s.high_pri_usage_ += charge
+      s.DemoteHighPri()
+    }
   } // else don't cache.  (Tests use capacity_==0 to turn off caching.)
+  opts.cached = cache
+  s.TrackHandle(e)
+
+  s.EvictToCapacity()
+
+  s.Unlock()
+  return e
+}
 
-  for s.usage_ > s.capacity_ && s.lru_.next != &s.lru_ {
+// Start or stop recording a stack trace for every handle returned to a
+// client.  Stopping forgets the handles recorded so far.
+func (s *LRUCache) SetDebugHandles(enabled bool) {
+  s.Lock()
+  if !enabled {
+    s.handle_stacks_ = nil
+  } else if s.handle_stacks_ == nil {
+    s.handle_stacks_ = make(map[*LRUHandle][]string)
+  }
+  s.Unlock()
+}
+
+// Record that a handle to "e" was returned to a client.  Requires mutex_
+// held.
+func (s *LRUCache) TrackHandle(e *LRUHandle) {
+  if s.handle_stacks_ != nil {
+    s.handle_stacks_[e] = append(s.handle_stacks_[e], string(debug.Stack()))
+  }
+}
+
+// Record that a handle to "e" was released.  Release() cannot tell which
+// of several handles to the same entry it was given, so the most recent
+// one is dropped.  Requires mutex_ held.
+func (s *LRUCache) UntrackHandle(e *LRUHandle) {
+  if s.handle_stacks_ == nil {
+    return
+  }
+  var stacks []string = s.handle_stacks_[e]
+  if len(stacks) <= 1 {
+    delete(s.handle_stacks_, e)
+  } else {
+    s.handle_stacks_[e] = stacks[:len(stacks) - 1]
+  }
+}
+
+// Return the handles that have been returned to clients and not released
+// yet.  Empty unless debugging handles.
+func (s *LRUCache) OutstandingHandles() []OutstandingHandle {
+  s.Lock()
+  defer s.mutex_.Unlock()
+  var handles []OutstandingHandle
+  for e, stacks := range s.handle_stacks_ {
+    for _, stack := range stacks {
+      var key []byte = append([]byte(nil), e.key_data[:e.key_length] ...)
+      handles = append(handles, OutstandingHandle{Key: key, Stack: stack})
+    }
+  }
+  return handles
+}
+
+// Render "handles" one per paragraph: the key followed by the stack trace
+// of the call that returned it.
+func FormatOutstandingHandles(handles []OutstandingHandle) string {
+  var buf bytes.Buffer
+  for _, h := range handles {
+    fmt.Fprintf(&buf, "handle for key %q acquired at:\n%s\n", h.Key, h.Stack)
+  }
+  return buf.String()
+}
+
+// Evict entries not in use until "charge" more fits in capacity_.
+// Return false if it cannot be made to fit.  Requires mutex_ held.
+func (s *LRUCache) MakeRoom(charge uint64) bool {
+  if charge > s.capacity_ {
+    return false
+  }
+  s.EvictUntil(s.capacity_ - charge, EvictionCapacity)
+  return s.usage_ + charge <= s.capacity_
+}
+
+// Evict entries not in use until usage_ fits in capacity_.  Requires
+// mutex_ held.
+func (s *LRUCache) EvictToCapacity() {
+  s.EvictUntil(s.capacity_, EvictionCapacity)
+}
+
+// Evict entries not in use, oldest first, until usage_ <= limit.
+// Requires mutex_ held.
+func (s *LRUCache) EvictUntil(limit uint64, reason EvictionReason) {
+  for s.usage_ > limit {
+    // Evict from probation first, then the protected segment; only touch
+    // the high-priority pool when nothing else is left.
     var old *LRUHandle = s.lru_.next
+    if old == &s.lru_ {
+      old = s.protected_.next
+    }
+    if old == &s.protected_ {
+      old = s.high_pri_.next
+      if old == &s.high_pri_ {
+        break
+      }
+    }
     if old.refs != 1 {
-      panic("Insert() error")
+      panic("EvictUntil() error")
     }
-    var erased bool = s.FinishErase(s.table_.Remove(old.key(), old.hash))
+    var erased bool = s.FinishErase(s.table_.Remove(old.key(), old.hash), reason)
     if !erased {
-      panic("Insert() error")
+      panic("EvictUntil() error")
+    }
+    if reason == EvictionCapacity {
+      atomic.AddUint64(&s.evictions_, 1)
     }
   }
-
-  s.mutex_.Unlock()
-  return e
 }
 
 // If e != NULL, finish removing *e from the cache; it has already been removed
 // from the hash table.  Return whether e != NULL.  Requires mutex_ held.
-func (s *LRUCache) FinishErase(e *LRUHandle) bool {
+func (s *LRUCache) FinishErase(e *LRUHandle, reason EvictionReason) bool {
   if e != nil {
     if !e.in_cache {
       panic("FinishErase() error")
     }
+    if s.on_evict_ != nil {
+      s.on_evict_(e.key(), e.value, reason)
+    }
+    if len(s.spilling_) > 0 {
+      s.StaleSpills(e.key(), e.hash)
+    }
+    if reason == EvictionCapacity && s.spill_ != nil && e.expire_at == 0 {
+      e.refs++  // Dropped by Unlock() once spill_ has seen the entry.
+      s.spilling_ = append(s.spilling_, e)
+      s.spilled_ = append(s.spilled_, e)
+    }
     s.LRU_Remove(e)
     e.in_cache = false
+    e.pinned = false
     s.usage_ -= e.charge
+    s.role_usage_[e.role] -= e.charge
+    if e.protected {
+      e.protected = false
+      s.protected_usage_ -= e.charge
+    }
+    if e.high_pri {
+      e.high_pri = false
+      s.high_pri_usage_ -= e.charge
+    }
     s.Unref(e)
   }
   return e != nil
 }
 
 func (s *LRUCache) Erase(key *Slice, hash uint32) {
-  s.mutex_.Lock()
-  s.FinishErase(s.table_.Remove(key, hash))
-  s.mutex_.Unlock()
+  s.Lock()
+  s.FinishErase(s.table_.Remove(key, hash), EvictionErase)
+  s.Unlock()
+}
+
+func (s *LRUCache) ErasePrefix(prefix *Slice) {
+  s.Lock()
+  for _, e := range s.table_.MatchPrefix(prefix) {
+    s.FinishErase(s.table_.Remove(e.key(), e.hash), EvictionErase)
+  }
+  s.Unlock()
 }
 
 func (s *LRUCache) Prune() {
-  s.mutex_.Lock()
-  for s.lru_.next != &s.lru_ {
-    var e *LRUHandle = s.lru_.next
-    if e.refs != 1 {
-      panic("Prune() error")
-    }
-    var erased bool = s.FinishErase(s.table_.Remove(e.key(), e.hash))
-    if !erased {  // to avoid unused variable when compiled NDEBUG
-      panic("Prune() error")
+  s.Lock()
+  for _, list := range []*LRUHandle{&s.lru_, &s.protected_, &s.high_pri_} {
+    for list.next != list {
+      var e *LRUHandle = list.next
+      if e.refs != 1 {
+        panic("Prune() error")
+      }
+      var erased bool = s.FinishErase(s.table_.Remove(e.key(), e.hash), EvictionPrune)
+      if !erased {  // to avoid unused variable when compiled NDEBUG
+        panic("Prune() error")
+      }
     }
   }
-  s.mutex_.Unlock()
+  s.Unlock()
+}
+
+func (s *LRUCache) PruneTo(target uint64) {
+  s.Lock()
+  s.EvictUntil(target, EvictionPrune)
+  s.Unlock()
 }
 
 func (s *LRUCache) TotalCharge() uint64 {
-  s.mutex_.Lock()
+  s.mutex_.RLock()
   var ret = s.usage_
-  s.mutex_.Unlock()
+  s.mutex_.RUnlock()
   return ret
 }
 
+func (s *LRUCache) ApplyToAllEntries(fn func(key *Slice, value interface{}, charge uint64)) {
+  s.Lock()
+  s.table_.ApplyToAll(func(h *LRUHandle) {
+    fn(h.key(), h.value, h.charge)
+  })
+  s.Unlock()
+}
+
+func (s *LRUCache) ShardStats() CacheShardStats {
+  var stats CacheShardStats
+  s.Lock()
+  stats.Usage = s.usage_
+  stats.Entries = uint64(s.table_.elems_)
+  s.Unlock()
+  stats.Hits = atomic.LoadUint64(&s.hits_)
+  stats.Misses = atomic.LoadUint64(&s.misses_)
+  return stats
+}
+
+// Call "fn" with the key of every entry in the cache, least recently used
+// first: probation, then the protected segment, then the high-priority
+// pool, then entries in use.
+func (s *LRUCache) ApplyToAllKeysInLRUOrder(fn func(key *Slice)) {
+  s.ApplyToAllEntriesInLRUOrder(func(key *Slice, value interface{}, charge uint64) {
+    fn(key)
+  })
+}
+
+// Same as ApplyToAllKeysInLRUOrder(), but also pass the value and charge.
+func (s *LRUCache) ApplyToAllEntriesInLRUOrder(fn func(key *Slice, value interface{}, charge uint64)) {
+  s.Lock()
+  for _, list := range []*LRUHandle{&s.lru_, &s.protected_, &s.high_pri_, &s.in_use_} {
+    for e := list.next; e != list; e = e.next {
+      fn(e.key(), e.value, e.charge)
+    }
+  }
+  s.Unlock()
+}
+
+func (s *LRUCache) Stats() CacheStats {
+  var stats CacheStats
+  stats.Hits = atomic.LoadUint64(&s.hits_)
+  stats.Misses = atomic.LoadUint64(&s.misses_)
+  stats.Inserts = atomic.LoadUint64(&s.inserts_)
+  stats.Evictions = atomic.LoadUint64(&s.evictions_)
+  s.mutex_.RLock()
+  stats.Usage = s.usage_
+  for r := 0; r < kNumCacheEntryRoles; r++ {
+    stats.Roles[r].Usage = s.role_usage_[r]
+  }
+  s.mutex_.RUnlock()
+  for r := 0; r < kNumCacheEntryRoles; r++ {
+    stats.Roles[r].Hits = atomic.LoadUint64(&s.role_hits_[r])
+  }
+  return stats
+}
+
+// Calls to GetOrInsert() that are loading a missing key, by key.
+type loadGroup struct {
+  mutex_ sync.Mutex
+  calls_ map[string]*loadCall
+}
+
+type loadCall struct {
+  done chan struct{}  // Closed when the load has finished.
+  err  error
+}
+
+// Implements Cache.GetOrInsert() on top of Lookup() and Insert().
+func getOrInsert(cache Cache, group *loadGroup, key *Slice, charge uint64,
+                 loader func() (interface{}, error), deleter LRUHandleDeleter) (CacheHandle, error) {
+  var k string = string(key.data())
+  for {
+    group.mutex_.Lock()
+    var call *loadCall = group.calls_[k]
+    if call != nil {
+      // Somebody else is loading this key; wait and look it up again.
+      group.mutex_.Unlock()
+      <-call.done
+      if call.err != nil {
+        return nil, call.err
+      }
+      continue
+    }
+    var handle CacheHandle = cache.Lookup(key)
+    if handle != nil {
+      group.mutex_.Unlock()
+      return handle, nil
+    }
+    call = &loadCall{done: make(chan struct{})}
+    if group.calls_ == nil {
+      group.calls_ = make(map[string]*loadCall)
+    }
+    group.calls_[k] = call
+    group.mutex_.Unlock()
+
+    defer func() {
+      group.mutex_.Lock()
+      delete(group.calls_, k)
+      group.mutex_.Unlock()
+      close(call.done)
+    }()
+    value, err := loader()
+    if err != nil {
+      call.err = err
+      return nil, err
+    }
+    return cache.Insert(key, value, charge, deleter), nil
+  }
+}
+
+// Per-entry insert parameters beyond key, value, charge and deleter.
+type insertOptions struct {
+  ttl      time.Duration   // <= 0 means the entry never expires.
+  priority CachePriority
+  owned_key bool          // Store key.data() instead of a copy.
+  fail_if_full bool       // Strict limit: return a nil handle instead of not caching.
+  role     CacheEntryRole
+  // Move an entry up from the compressed tier after a Lookup() missed:
+  // return the entry already cached under the key, if any, and count a
+  // hit instead of that miss and of an insert.
+  promote  bool
+  cached   bool           // Set by InsertEntry(): whether the entry is cached.
+}
+
+// Copy every entry resident in "src" into "dst", so that a cache can be
+// reconfigured (different capacity, shard layout or eviction policy)
+// without starting cold.  The copies are inserted with "deleter"; the
+// entries in "src" are left in place with their own deleters, so values
+// end up shared by both caches until "src" is dropped.  Entries that do
+// not fit in "dst" are evicted by it as usual.  Returns the number of
+// entries copied.
+//
+// If "src" is an LRU cache, entries are copied least recently used first,
+// so that "dst" evicts the coldest ones and keeps a similar recency order.
+// Shards have no common clock, so entries of different shards are merged
+// by their relative position in their shard.  Other caches are copied in
+// no particular order.
+func CopyCacheEntries(dst Cache, src Cache, deleter LRUHandleDeleter) int {
+  type entry struct {
+    key    *Slice
+    value  interface{}
+    charge uint64
+    rank   float64  // Position in its shard's LRU order, in [0, 1).
+  }
+  // Collect first: the Apply* methods hold src locks while visiting.
+  var entries []entry
+  var collect = func(key *Slice, value interface{}, charge uint64) {
+    var k []byte = append([]byte(nil), key.data() ...)
+    entries = append(entries, entry{NewSlice(k), value, charge, 0})
+  }
+  if lru, ok := src.(*ShardedLRUCache); ok {
+    for s := 0; s < kNumShards; s++ {
+      var begin int = len(entries)
+      lru.shard_[s].ApplyToAllEntriesInLRUOrder(collect)
+      for i := begin; i < len(entries); i++ {
+        entries[i].rank = float64(i - begin) / float64(len(entries) - begin)
+      }
+    }
+    sort.SliceStable(entries, func(i, j int) bool {
+      return entries[i].rank < entries[j].rank
+    })
+  } else {
+    src.ApplyToAllEntries(collect)
+  }
+  for _, e := range entries {
+    dst.Release(dst.InsertOwnedKey(e.key, e.value, e.charge, deleter))
+  }
+  return len(entries)
+}
+
 const kNumShardBits = uint32(4)
 const kNumShards    = 1 << kNumShardBits
 
 type ShardedLRUCache struct {
   shard_    [kNumShards]*LRUCache
+  loads_    [kNumShards]loadGroup
   id_mutex_ sync.Mutex
   last_id_  uint64
+  tier_     *compressedTier  // May be nil.
 }
 
 func (t *ShardedLRUCache) HashSlice(s *Slice) uint32 {
@@ -435,25 +1513,154 @@ func (t *ShardedLRUCache) Shard(hash uint32) uint32 {
 }
 
 func ConstructShardedLRUCache(capacity uint64) *ShardedLRUCache {
+  var options LRUCacheOptions
+  options.Capacity = capacity
+  return ConstructShardedLRUCacheWithOptions(options)
+}
+
+func ConstructShardedLRUCacheWithOptions(options LRUCacheOptions) *ShardedLRUCache {
   var slru *ShardedLRUCache = new(ShardedLRUCache)
   slru.last_id_ = 0
-  var per_shard uint64 = uint64((capacity + (kNumShards - 1)) / kNumShards)
+  var per_shard uint64 = uint64((options.Capacity + (kNumShards - 1)) / kNumShards)
+  var high_pri_ratio float64 = options.HighPriPoolRatio
+  if high_pri_ratio == 0 {
+    high_pri_ratio = kDefaultHighPriPoolRatio
+  }
   for s := 0; s < kNumShards; s++ {
     var lru_cache *LRUCache = ConstructLRUCache()
     slru.shard_[s] = lru_cache
     slru.shard_[s].SetCapacity(per_shard)
+    slru.shard_[s].SetProtectedRatio(options.ProtectedRatio)
+    slru.shard_[s].SetHighPriPoolRatio(high_pri_ratio)
+    slru.shard_[s].SetStrictCapacityLimit(options.StrictCapacityLimit)
+    slru.shard_[s].SetDebugHandles(options.DebugHandles)
+    slru.shard_[s].SetSizer(options.Sizer)
+  }
+  if options.CompressedTier != nil {
+    slru.tier_ = newCompressedTier(options.CompressedTier)
+    for s := 0; s < kNumShards; s++ {
+      slru.shard_[s].SetSpill(slru.tier_.Spill)
+    }
   }
   return slru
 }
 
+// Return the compressed second tier, e.g. for its Stats(), or nil if the
+// cache has none.
+func (t *ShardedLRUCache) CompressedTier() Cache {
+  if t.tier_ == nil {
+    return nil
+  }
+  return t.tier_.cache_
+}
+
+// Drop the compressed copy of "key", which a new insert makes stale.
+func (t *ShardedLRUCache) EraseFromTier(key *Slice) {
+  if t.tier_ != nil {
+    t.tier_.cache_.Erase(key)
+  }
+}
+
+func (t *ShardedLRUCache) SetCapacity(capacity uint64) {
+  var per_shard uint64 = uint64((capacity + (kNumShards - 1)) / kNumShards)
+  for s := 0; s < kNumShards; s++ {
+    t.shard_[s].SetCapacity(per_shard)
+  }
+}
+
+// Register "listener" to be told about every entry leaving the cache.
+// Pass nil to remove it.
+func (t *ShardedLRUCache) SetEvictionListener(listener EvictionListener) {
+  for s := 0; s < kNumShards; s++ {
+    t.shard_[s].SetEvictionListener(listener)
+  }
+}
+
 func (t *ShardedLRUCache) Insert(key *Slice, value interface{}, charge uint64, deleter LRUHandleDeleter) CacheHandle {
+  t.EraseFromTier(key)
   var hash uint32 = t.HashSlice(key)
   return t.shard_[t.Shard(hash)].Insert(key, hash, value, charge, deleter)
 }
 
+func (t *ShardedLRUCache) InsertWithTTL(key *Slice, value interface{}, charge uint64,
+                                        ttl time.Duration, deleter LRUHandleDeleter) CacheHandle {
+  t.EraseFromTier(key)
+  var hash uint32 = t.HashSlice(key)
+  return t.shard_[t.Shard(hash)].InsertWithTTL(key, hash, value, charge, ttl, deleter)
+}
+
+func (t *ShardedLRUCache) InsertWithPriority(key *Slice, value interface{}, charge uint64,
+                                             priority CachePriority, deleter LRUHandleDeleter) CacheHandle {
+  t.EraseFromTier(key)
+  var hash uint32 = t.HashSlice(key)
+  var opts = insertOptions{priority: priority}
+  return t.shard_[t.Shard(hash)].InsertEntry(key, hash, value, charge, deleter, &opts)
+}
+
+func (t *ShardedLRUCache) InsertWithRole(key *Slice, value interface{}, charge uint64,
+                                         role CacheEntryRole, deleter LRUHandleDeleter) CacheHandle {
+  t.EraseFromTier(key)
+  var hash uint32 = t.HashSlice(key)
+  var opts = insertOptions{role: role}
+  return t.shard_[t.Shard(hash)].InsertEntry(key, hash, value, charge, deleter, &opts)
+}
+
+func (t *ShardedLRUCache) InsertOwnedKey(key *Slice, value interface{}, charge uint64,
+                                         deleter LRUHandleDeleter) CacheHandle {
+  t.EraseFromTier(key)
+  var hash uint32 = t.HashSlice(key)
+  var opts = insertOptions{owned_key: true}
+  return t.shard_[t.Shard(hash)].InsertEntry(key, hash, value, charge, deleter, &opts)
+}
+
+func (t *ShardedLRUCache) SetStrictCapacityLimit(strict bool) {
+  for s := 0; s < kNumShards; s++ {
+    t.shard_[s].SetStrictCapacityLimit(strict)
+  }
+}
+
+func (t *ShardedLRUCache) TryInsert(key *Slice, value interface{}, charge uint64,
+                                    deleter LRUHandleDeleter) (CacheHandle, error) {
+  t.EraseFromTier(key)
+  var hash uint32 = t.HashSlice(key)
+  var opts = insertOptions{fail_if_full: true}
+  var h CacheHandle = t.shard_[t.Shard(hash)].InsertEntry(key, hash, value, charge, deleter, &opts)
+  if h == nil {
+    return nil, ErrCacheFull
+  }
+  return h, nil
+}
+
 func (t *ShardedLRUCache) Lookup(key *Slice) CacheHandle {
   var hash uint32 = t.HashSlice(key)
-  return t.shard_[t.Shard(hash)].Lookup(key, hash)
+  var h CacheHandle = t.shard_[t.Shard(hash)].Lookup(key, hash)
+  if h == nil && t.tier_ != nil {
+    // Fall through to the compressed tier and move a hit back up.  The
+    // original deleter already ran when the entry was evicted, so the
+    // decompressed copy goes back without one; an entry inserted in the
+    // meantime wins over it.  The compressed copy is only dropped once
+    // the entry is cached again.
+    value, charge, role, ok := t.tier_.Get(key)
+    if ok {
+      var opts = insertOptions{promote: true, role: role}
+      h = t.shard_[t.Shard(hash)].InsertEntry(key, hash, value, charge, noopDeleter, &opts)
+      if opts.cached {
+        t.EraseFromTier(key)
+      }
+    }
+  }
+  return h
+}
+
+func (t *ShardedLRUCache) GetOrInsert(key *Slice, charge uint64, loader func() (interface{}, error),
+                                      deleter LRUHandleDeleter) (CacheHandle, error) {
+  var hash uint32 = t.HashSlice(key)
+  return getOrInsert(t, &t.loads_[t.Shard(hash)], key, charge, loader, deleter)
+}
+
+func (t *ShardedLRUCache) Peek(key *Slice) (interface{}, bool) {
+  var hash uint32 = t.HashSlice(key)
+  return t.shard_[t.Shard(hash)].Peek(key, hash)
 }
 
 func (t *ShardedLRUCache) Release(handle CacheHandle) {
@@ -464,11 +1671,20 @@ func (t *ShardedLRUCache) Release(handle CacheHandle) {
 func (t *ShardedLRUCache) Erase(key *Slice) {
   var hash uint32 = t.HashSlice(key)
   t.shard_[t.Shard(hash)].Erase(key, hash)
+  t.EraseFromTier(key)
 }
 
 func (t *ShardedLRUCache) Value(handle CacheHandle) interface{} {
-  var h *LRUHandle = (handle).(*LRUHandle)
-  return h.value
+  return handle.Value()
+}
+
+func (t *ShardedLRUCache) ErasePrefix(prefix *Slice) {
+  for s := 0; s < kNumShards; s++ {
+    t.shard_[s].ErasePrefix(prefix)
+  }
+  if t.tier_ != nil {
+    t.tier_.cache_.ErasePrefix(prefix)
+  }
 }
 
 func (t *ShardedLRUCache) NewId() uint64 {
@@ -483,6 +1699,55 @@ func (t *ShardedLRUCache) Prune() {
   for s := 0; s < kNumShards; s++ {
     t.shard_[s].Prune()
   }
+  if t.tier_ != nil {
+    t.tier_.cache_.Prune()
+  }
+}
+
+func (t *ShardedLRUCache) PruneTo(target uint64) {
+  var usage [kNumShards]uint64
+  for s := 0; s < kNumShards; s++ {
+    usage[s] = t.shard_[s].TotalCharge()
+  }
+  var targets [kNumShards]uint64 = pruneTargets(usage, target)
+  for s := 0; s < kNumShards; s++ {
+    if targets[s] < usage[s] {
+      t.shard_[s].PruneTo(targets[s])
+    }
+  }
+}
+
+// Split a cache-wide PruneTo() "target" into per-shard targets.  Shards
+// give up the excess over "target" in proportion to their "usage", so an
+// almost empty cache is not wiped just because target / kNumShards
+// rounds down to nothing.
+func pruneTargets(usage [kNumShards]uint64, target uint64) [kNumShards]uint64 {
+  var total uint64 = 0
+  for s := 0; s < kNumShards; s++ {
+    total += usage[s]
+  }
+  if total <= target {
+    return usage
+  }
+  var excess uint64 = total - target
+  var targets [kNumShards]uint64
+  var assigned uint64 = 0
+  for s := 0; s < kNumShards; s++ {
+    // excess * usage[s] / total without overflow; the quotient fits since
+    // excess <= total.
+    hi, lo := bits.Mul64(excess, usage[s])
+    share, _ := bits.Div64(hi, lo, total)
+    targets[s] = usage[s] - share
+    assigned += share
+  }
+  // Hand out what rounding down left over, one unit per shard.
+  for s := 0; assigned < excess; s = (s + 1) % kNumShards {
+    if targets[s] > 0 {
+      targets[s]--
+      assigned++
+    }
+  }
+  return targets
 }
 
 func (t *ShardedLRUCache) TotalCharge() uint64 {
@@ -493,6 +1758,116 @@ func (t *ShardedLRUCache) TotalCharge() uint64 {
   return total
 }
 
+func (t *ShardedLRUCache) ApplyToAllEntries(fn func(key *Slice, value interface{}, charge uint64)) {
+  for s := 0; s < kNumShards; s++ {
+    t.shard_[s].ApplyToAllEntries(fn)
+  }
+}
 
+func (t *ShardedLRUCache) Stats() CacheStats {
+  var total CacheStats
+  for s := 0; s < kNumShards; s++ {
+    var stats CacheStats = t.shard_[s].Stats()
+    total.Hits += stats.Hits
+    total.Misses += stats.Misses
+    total.Inserts += stats.Inserts
+    total.Evictions += stats.Evictions
+    total.Usage += stats.Usage
+    addRoleStats(&total, &stats)
+  }
+  return total
+}
+
+// Return the statistics of every shard, indexed by shard number.  A shard
+// whose usage or lookups are far above the others points at hash skew.
+func (t *ShardedLRUCache) ShardStats() []CacheShardStats {
+  var stats []CacheShardStats = make([]CacheShardStats, kNumShards)
+  for s := 0; s < kNumShards; s++ {
+    stats[s] = t.shard_[s].ShardStats()
+  }
+  return stats
+}
+
+// Return the handles returned by Lookup() or an insert that have not been
+// Released yet, with the stack trace of the call that returned each one.
+// Always empty unless the cache was created with
+// LRUCacheOptions.DebugHandles.
+func (t *ShardedLRUCache) OutstandingHandles() []OutstandingHandle {
+  var handles []OutstandingHandle
+  for s := 0; s < kNumShards; s++ {
+    handles = append(handles, t.shard_[s].OutstandingHandles()...)
+  }
+  return handles
+}
 
+// Longest key WarmUp() accepts; anything longer means the input is corrupt.
+const kMaxSavedKeyLength = 1 << 20
+
+// Write the keys (not the values) of all resident entries to "w", so that
+// WarmUp() can re-populate the cache after a restart.  The shards are
+// written one after another, each in LRU order (least recently used
+// first); there is no order across shards.  Each key is written as a
+// 64-bit varint (binary.PutUvarint) length followed by the key bytes.
+func (t *ShardedLRUCache) SaveKeys(w io.Writer) error {
+  var buf *bufio.Writer = bufio.NewWriter(w)
+  var lenbuf [binary.MaxVarintLen64]byte
+  var err error
+  for s := 0; s < kNumShards && err == nil; s++ {
+    // Copy the keys so that no shard lock is held while writing.
+    var keys [][]byte
+    t.shard_[s].ApplyToAllKeysInLRUOrder(func(key *Slice) {
+      keys = append(keys, append([]byte(nil), key.data() ...))
+    })
+    for _, key := range keys {
+      var n int = binary.PutUvarint(lenbuf[:], uint64(len(key)))
+      if _, err = buf.Write(lenbuf[:n]); err != nil {
+        break
+      }
+      if _, err = buf.Write(key); err != nil {
+        break
+      }
+    }
+  }
+  if err != nil {
+    return err
+  }
+  return buf.Flush()
+}
 
+// Loads the value of a key saved by SaveKeys() for WarmUp().
+type CacheLoader func(key *Slice) (value interface{}, charge uint64, err error)
+
+// Re-populate the cache with the keys written by SaveKeys(), calling
+// "loader" for each key and inserting the result with "deleter".  Keys
+// whose loader fails are skipped, since the data they referred to may be
+// gone by now.  Returns the number of entries inserted, and an error only
+// if "r" could not be read or parsed.
+func (t *ShardedLRUCache) WarmUp(r io.Reader, loader CacheLoader, deleter LRUHandleDeleter) (int, error) {
+  var buf *bufio.Reader = bufio.NewReader(r)
+  var loaded int = 0
+  for {
+    length, err := binary.ReadUvarint(buf)
+    if err == io.EOF {
+      return loaded, nil
+    }
+    if err != nil {
+      return loaded, err
+    }
+    if length > kMaxSavedKeyLength {
+      return loaded, errors.New("WarmUp(): bad key length")
+    }
+    var key []byte = make([]byte, length)
+    if _, err = io.ReadFull(buf, key); err != nil {
+      if err == io.EOF {
+        err = io.ErrUnexpectedEOF
+      }
+      return loaded, err
+    }
+    value, charge, err := loader(NewSlice(key))
+    if err != nil {
+      continue
+    }
+    t.Release(t.InsertOwnedKey(NewSlice(key), value, charge, deleter))
+    loaded++
+  }
+}
@@ -6,8 +6,16 @@ package util
 
 import (
   "testing"
+  "bytes"
   "encoding/binary"
+  "errors"
   "fmt"
+  "io"
+  "math/rand"
+  "strings"
+  "sync"
+  "sync/atomic"
+  "time"
 )
 
 func EncodeKey(k int) []byte {
@@ -52,14 +60,13 @@ func ConstructCacheTest() *CacheTest {
 
 func (s *CacheTest) Lookup(key int) int {
   var handle CacheHandle = s.cache_.Lookup(NewSlice(EncodeKey(key)))
-  var lru_handle *LRUHandle = handle.(*LRUHandle)
   var r int
-  if lru_handle == nil {
+  if handle == nil {
     r = -1
   } else {
     r = DecodeValue(s.cache_.Value(handle))
   }
-  if lru_handle != nil {
+  if handle != nil {
     s.cache_.Release(handle)
   }
   return r
@@ -69,6 +76,10 @@ func (s *CacheTest) Insert(key int, value int, charge uint64) {
   s.cache_.Release(s.cache_.Insert(NewSlice(EncodeKey(key)), value, charge, Deleter))
 }
 
+func (s *CacheTest) InsertWithTTL(key int, value int, charge uint64, ttl time.Duration) {
+  s.cache_.Release(s.cache_.InsertWithTTL(NewSlice(EncodeKey(key)), value, charge, ttl, Deleter))
+}
+
 func (s *CacheTest) InsertAndReturnHandle(key int, value int, charge uint64) CacheHandle {
   return s.cache_.Insert(NewSlice(EncodeKey(key)), value, charge, Deleter)
 }
@@ -266,7 +277,7 @@ func TestCache_Prune(t *testing.T) {
   current_8.Insert(2, 200, 1)
 
   var handle CacheHandle = current_8.cache_.Lookup(NewSlice(EncodeKey(1)))
-  if handle.(*LRUHandle) == nil {
+  if handle == nil {
     panic("TestCache_Prune() error.")
   }
   current_8.cache_.Prune()
@@ -275,3 +286,1103 @@ func TestCache_Prune(t *testing.T) {
   ASSERT_EQ(100, current_8.Lookup(1))
   ASSERT_EQ(-1,  current_8.Lookup(2))
 }
+
+func TestCache_Stats(t *testing.T) {
+  var current_9 *CacheTest = ConstructCacheTest()
+  current_deleted_keys = current_deleted_keys[:0]
+  current_deleted_values = current_deleted_values[:0]
+
+  current_9.Insert(100, 101, 1)
+  current_9.Insert(200, 201, 2)
+  ASSERT_EQ(101, current_9.Lookup(100))
+  ASSERT_EQ(201, current_9.Lookup(200))
+  ASSERT_EQ(-1, current_9.Lookup(300))
+
+  var stats CacheStats = current_9.cache_.Stats()
+  ASSERT_EQ(2, int(stats.Hits))
+  ASSERT_EQ(1, int(stats.Misses))
+  ASSERT_EQ(2, int(stats.Inserts))
+  ASSERT_EQ(0, int(stats.Evictions))
+  ASSERT_EQ(3, int(stats.Usage))
+
+  // Overfill the cache so some entries get evicted.
+  for i := 0; i < 2*kCacheSize; i++ {
+    current_9.Insert(1000+i, 2000+i, 1)
+  }
+  stats = current_9.cache_.Stats()
+  ASSERT_EQ(2 + 2*kCacheSize, int(stats.Inserts))
+  ASSERT_EQ(len(current_deleted_keys), int(stats.Evictions))
+  ASSERT_EQ(int(current_9.cache_.TotalCharge()), int(stats.Usage))
+}
+
+func TestCache_TTL(t *testing.T) {
+  var current_10 *CacheTest = ConstructCacheTest()
+  current_deleted_keys = current_deleted_keys[:0]
+  current_deleted_values = current_deleted_values[:0]
+
+  current_10.InsertWithTTL(100, 101, 1, time.Millisecond)
+  current_10.InsertWithTTL(200, 201, 1, time.Hour)
+  current_10.InsertWithTTL(300, 301, 1, 0)
+  var h CacheHandle = current_10.cache_.InsertWithTTL(NewSlice(EncodeKey(400)), 401, 1,
+                                                      time.Millisecond, Deleter)
+  ASSERT_EQ(101, current_10.Lookup(100))
+  ASSERT_EQ(4, int(current_10.cache_.TotalCharge()))
+
+  time.Sleep(10 * time.Millisecond)
+
+  // Expired entries are misses and get dropped on lookup.
+  ASSERT_EQ(-1, current_10.Lookup(100))
+  ASSERT_EQ(201, current_10.Lookup(200))
+  ASSERT_EQ(301, current_10.Lookup(300))
+  ASSERT_EQ(1, len(current_deleted_keys))
+  ASSERT_EQ(100, current_deleted_keys[0])
+  ASSERT_EQ(101, current_deleted_values[0])
+  ASSERT_EQ(3, int(current_10.cache_.TotalCharge()))
+
+  // A pinned entry is deleted once its last handle is released.
+  ASSERT_EQ(-1, current_10.Lookup(400))
+  ASSERT_EQ(2, int(current_10.cache_.TotalCharge()))
+  ASSERT_EQ(1, len(current_deleted_keys))
+  ASSERT_EQ(401, DecodeValue(current_10.cache_.Value(h)))
+  current_10.cache_.Release(h)
+  ASSERT_EQ(2, len(current_deleted_keys))
+  ASSERT_EQ(400, current_deleted_keys[1])
+}
+
+func TestCache_SegmentedLRUScanResistance(t *testing.T) {
+  var options LRUCacheOptions
+  options.Capacity = kCacheSize
+  options.ProtectedRatio = 0.5
+  var current_11 *CacheTest = new(CacheTest)
+  current_11.cache_ = NewLRUCacheWithOptions(options)
+  current_deleted_keys = current_deleted_keys[:0]
+  current_deleted_values = current_deleted_values[:0]
+
+  // Build a small hot working set and promote it by looking it up.
+  const kHot = 32
+  for i := 0; i < kHot; i++ {
+    current_11.Insert(i, 100+i, 1)
+    ASSERT_EQ(100+i, current_11.Lookup(i))
+  }
+
+  // A one-shot scan much larger than the cache only churns probation.
+  for i := 0; i < 10*kCacheSize; i++ {
+    current_11.Insert(1000+i, 2000+i, 1)
+  }
+  for i := 0; i < kHot; i++ {
+    ASSERT_EQ(100+i, current_11.Lookup(i))
+  }
+  ASSERT_LE(int(current_11.cache_.TotalCharge()), kCacheSize + kNumShards)
+
+  // The same workload flushes the hot set from a plain LRU cache.
+  var current_12 *CacheTest = ConstructCacheTest()
+  for i := 0; i < kHot; i++ {
+    current_12.Insert(i, 100+i, 1)
+    ASSERT_EQ(100+i, current_12.Lookup(i))
+  }
+  for i := 0; i < 10*kCacheSize; i++ {
+    current_12.Insert(1000+i, 2000+i, 1)
+  }
+  for i := 0; i < kHot; i++ {
+    ASSERT_EQ(-1, current_12.Lookup(i))
+  }
+}
+
+func TestCache_SegmentedLRUDemotion(t *testing.T) {
+  var shard *LRUCache = ConstructLRUCache()
+  shard.SetCapacity(10)
+  shard.SetProtectedRatio(0.2)  // two protected entries
+  current_deleted_keys = current_deleted_keys[:0]
+  current_deleted_values = current_deleted_values[:0]
+
+  var insert = func(k int) {
+    var key *Slice = NewSlice(EncodeKey(k))
+    shard.Release(shard.Insert(key, Hash(key.data(), 0), k, 1, Deleter))
+  }
+  var lookup = func(k int) bool {
+    var key *Slice = NewSlice(EncodeKey(k))
+    var h CacheHandle = shard.Lookup(key, Hash(key.data(), 0))
+    if h != nil {
+      shard.Release(h)
+    }
+    return h != nil
+  }
+
+  for k := 1; k <= 3; k++ {
+    insert(k)
+    lookup(k)
+  }
+  // Protecting 3 demoted 1, the oldest protected entry, to probation.
+  shard.ApplyHits()  // Lookups only log their hits.
+  ASSERT_EQ(2, int(shard.protected_usage_))
+  if !shard.lru_.next.key().Equal(NewSlice(EncodeKey(1))) {
+    panic("TestCache_SegmentedLRUDemotion() error")
+  }
+
+  // Filling the cache evicts probation (including 1) before 2 and 3.
+  for k := 10; k < 20; k++ {
+    insert(k)
+  }
+  ASSERT_EQ(10, int(shard.TotalCharge()))
+  if lookup(1) || !lookup(2) || !lookup(3) {
+    panic("TestCache_SegmentedLRUDemotion() error")
+  }
+
+  shard.Prune()
+  ASSERT_EQ(0, int(shard.TotalCharge()))
+  ASSERT_EQ(0, int(shard.protected_usage_))
+}
+
+func TestCache_SetCapacity(t *testing.T) {
+  var current_13 *CacheTest = ConstructCacheTest()
+  current_deleted_keys = current_deleted_keys[:0]
+  current_deleted_values = current_deleted_values[:0]
+
+  for i := 0; i < kCacheSize; i++ {
+    current_13.Insert(i, 1000+i, 1)
+  }
+  var h CacheHandle = current_13.cache_.Lookup(NewSlice(EncodeKey(0)))
+
+  // Shrinking evicts down to the new limit but keeps pinned entries.
+  current_13.cache_.SetCapacity(kCacheSize / 10)
+  ASSERT_LE(int(current_13.cache_.TotalCharge()), kCacheSize / 10 + kNumShards)
+  ASSERT_EQ(1000, current_13.Lookup(0))
+  ASSERT_EQ(int(current_13.cache_.Stats().Evictions), len(current_deleted_keys))
+  current_13.cache_.Release(h)
+
+  // Growing lets the cache hold more entries again.
+  current_13.cache_.SetCapacity(2 * kCacheSize)
+  for i := 0; i < kCacheSize; i++ {
+    current_13.Insert(kCacheSize+i, 1000+i, 1)
+  }
+  ASSERT_LE(kCacheSize, int(current_13.cache_.TotalCharge()))
+}
+
+func TestCache_Peek(t *testing.T) {
+  var shard *LRUCache = ConstructLRUCache()
+  shard.SetCapacity(2)
+  current_deleted_keys = current_deleted_keys[:0]
+  current_deleted_values = current_deleted_values[:0]
+
+  var insert = func(k int) {
+    var key *Slice = NewSlice(EncodeKey(k))
+    shard.Release(shard.Insert(key, Hash(key.data(), 0), 100+k, 1, Deleter))
+  }
+  var peek = func(k int) int {
+    var key *Slice = NewSlice(EncodeKey(k))
+    v, ok := shard.Peek(key, Hash(key.data(), 0))
+    if !ok {
+      return -1
+    }
+    return DecodeValue(v)
+  }
+
+  insert(1)
+  insert(2)
+  ASSERT_EQ(101, peek(1))
+  ASSERT_EQ(102, peek(2))
+  ASSERT_EQ(-1, peek(3))
+  ASSERT_EQ(0, int(shard.Stats().Hits + shard.Stats().Misses))
+
+  // Peeking at 1 did not make it more recent than 2, so it is evicted first.
+  insert(3)
+  ASSERT_EQ(-1, peek(1))
+  ASSERT_EQ(102, peek(2))
+  ASSERT_EQ(1, len(current_deleted_keys))
+  ASSERT_EQ(1, current_deleted_keys[0])
+}
+
+func TestCache_GetOrInsert(t *testing.T) {
+  var current_14 *CacheTest = ConstructCacheTest()
+  current_deleted_keys = current_deleted_keys[:0]
+  current_deleted_values = current_deleted_values[:0]
+
+  current_14.Insert(100, 101, 1)
+  var loads int32 = 0
+  var loader = func() (interface{}, error) {
+    atomic.AddInt32(&loads, 1)
+    time.Sleep(10 * time.Millisecond)
+    return 201, nil
+  }
+
+  // An existing entry is returned without calling the loader.
+  h, err := current_14.cache_.GetOrInsert(NewSlice(EncodeKey(100)), 1, loader, Deleter)
+  if err != nil {
+    panic("TestCache_GetOrInsert() error")
+  }
+  ASSERT_EQ(101, DecodeValue(current_14.cache_.Value(h)))
+  current_14.cache_.Release(h)
+  ASSERT_EQ(0, int(atomic.LoadInt32(&loads)))
+
+  // Concurrent misses on the same key share one load.
+  var wg sync.WaitGroup
+  for g := 0; g < 8; g++ {
+    wg.Add(1)
+    go func() {
+      defer wg.Done()
+      h, err := current_14.cache_.GetOrInsert(NewSlice(EncodeKey(200)), 1, loader, Deleter)
+      if err != nil {
+        panic("TestCache_GetOrInsert() error")
+      }
+      ASSERT_EQ(201, DecodeValue(current_14.cache_.Value(h)))
+      current_14.cache_.Release(h)
+    }()
+  }
+  wg.Wait()
+  ASSERT_EQ(1, int(atomic.LoadInt32(&loads)))
+  ASSERT_EQ(201, current_14.Lookup(200))
+
+  // A failed load inserts nothing.
+  var kLoadError = errors.New("load error")
+  _, err = current_14.cache_.GetOrInsert(NewSlice(EncodeKey(300)), 1,
+                                         func() (interface{}, error) {
+                                           return nil, kLoadError
+                                         }, Deleter)
+  if err != kLoadError {
+    panic("TestCache_GetOrInsert() error")
+  }
+  ASSERT_EQ(-1, current_14.Lookup(300))
+}
+
+func TestCache_ApplyToAllEntries(t *testing.T) {
+  var current_15 *CacheTest = ConstructCacheTest()
+  current_deleted_keys = current_deleted_keys[:0]
+  current_deleted_values = current_deleted_values[:0]
+
+  for i := 0; i < 100; i++ {
+    current_15.Insert(i, 1000+i, uint64(i % 3 + 1))
+  }
+  var h CacheHandle = current_15.cache_.Lookup(NewSlice(EncodeKey(7)))
+  current_15.Erase(50)
+
+  var seen = make(map[int]int)
+  var total_charge uint64 = 0
+  current_15.cache_.ApplyToAllEntries(func(key *Slice, value interface{}, charge uint64) {
+    seen[DecodeKey(key)] = DecodeValue(value)
+    total_charge += charge
+  })
+  ASSERT_EQ(99, len(seen))
+  for i := 0; i < 100; i++ {
+    v, ok := seen[i]
+    if i == 50 {
+      if ok {
+        panic("TestCache_ApplyToAllEntries() error")
+      }
+      continue
+    }
+    ASSERT_EQ(1000+i, v)
+  }
+  ASSERT_EQ(int(current_15.cache_.TotalCharge()), int(total_charge))
+  current_15.cache_.Release(h)
+}
+
+func TestCache_EvictionListener(t *testing.T) {
+  var current_16 *CacheTest = ConstructCacheTest()
+  current_deleted_keys = current_deleted_keys[:0]
+  current_deleted_values = current_deleted_values[:0]
+
+  var evicted = make(map[EvictionReason][]int)
+  current_16.cache_.(*ShardedLRUCache).SetEvictionListener(
+      func(key *Slice, value interface{}, reason EvictionReason) {
+        evicted[reason] = append(evicted[reason], DecodeKey(key))
+      })
+
+  current_16.Insert(100, 101, 1)
+  current_16.Insert(100, 102, 1)
+  ASSERT_EQ(1, len(evicted[EvictionReplace]))
+  ASSERT_EQ(100, evicted[EvictionReplace][0])
+
+  // The listener fires when the entry leaves the cache, even if it is
+  // still pinned; the deleter waits for the release.
+  var h CacheHandle = current_16.cache_.Lookup(NewSlice(EncodeKey(100)))
+  current_16.Erase(100)
+  ASSERT_EQ(1, len(evicted[EvictionErase]))
+  ASSERT_EQ(1, len(current_deleted_keys))
+  current_16.cache_.Release(h)
+  ASSERT_EQ(2, len(current_deleted_keys))
+
+  current_16.InsertWithTTL(200, 201, 1, time.Millisecond)
+  time.Sleep(10 * time.Millisecond)
+  ASSERT_EQ(-1, current_16.Lookup(200))
+  ASSERT_EQ(1, len(evicted[EvictionExpired]))
+
+  for i := 0; i < 2*kCacheSize; i++ {
+    current_16.Insert(1000+i, 2000+i, 1)
+  }
+  ASSERT_EQ(int(current_16.cache_.Stats().Evictions), len(evicted[EvictionCapacity]))
+
+  var remaining int = int(current_16.cache_.TotalCharge())
+  current_16.cache_.Prune()
+  ASSERT_EQ(remaining, len(evicted[EvictionPrune]))
+
+  if EvictionCapacity.String() != "capacity" || EvictionReplace.String() != "replace" {
+    panic("TestCache_EvictionListener() error")
+  }
+}
+
+func TestCache_Priority(t *testing.T) {
+  const kHigh = 32
+  var insertHigh = func(c *CacheTest) {
+    for i := 0; i < kHigh; i++ {
+      c.cache_.Release(c.cache_.InsertWithPriority(
+          NewSlice(EncodeKey(i)), 100+i, 1, CachePriorityHigh, Deleter))
+    }
+  }
+
+  // High-priority entries survive a flood of low-priority inserts even
+  // though they are never looked up, with the default options.
+  var current_17 *CacheTest = ConstructCacheTest()
+  current_deleted_keys = current_deleted_keys[:0]
+  current_deleted_values = current_deleted_values[:0]
+  insertHigh(current_17)
+  for i := 0; i < 10*kCacheSize; i++ {
+    current_17.Insert(1000+i, 2000+i, 1)
+  }
+  for i := 0; i < kHigh; i++ {
+    ASSERT_EQ(100+i, current_17.Lookup(i))
+  }
+
+  // Low-priority entries that are looked up, and so protected by the
+  // SLRU, still do not push them out.
+  var options LRUCacheOptions
+  options.Capacity = kCacheSize
+  options.ProtectedRatio = 0.5
+  var current_18 *CacheTest = new(CacheTest)
+  current_18.cache_ = NewLRUCacheWithOptions(options)
+  insertHigh(current_18)
+  for i := 0; i < 10*kCacheSize; i++ {
+    current_18.Insert(1000+i, 2000+i, 1)
+    current_18.Lookup(1000+i)
+  }
+  for i := 0; i < kHigh; i++ {
+    ASSERT_EQ(100+i, current_18.Lookup(i))
+  }
+
+  // Without a high-priority pool, priorities are ignored.
+  var shard *LRUCache = ConstructLRUCache()
+  shard.SetCapacity(10)
+  for i := 0; i < 20; i++ {
+    var key *Slice = NewSlice(EncodeKey(i))
+    var priority CachePriority = CachePriorityLow
+    if i == 0 {
+      priority = CachePriorityHigh
+    }
+    shard.Release(shard.InsertEntry(key, Hash(key.data(), 0), 100+i, 1, Deleter,
+                                    &insertOptions{priority: priority}))
+  }
+  var key *Slice = NewSlice(EncodeKey(0))
+  if shard.Lookup(key, Hash(key.data(), 0)) != nil {
+    panic("TestCache_Priority() error")
+  }
+  shard.SetHighPriPoolRatio(0.5)
+
+  // The pool is bounded: once it is full, its oldest entries are demoted
+  // to low priority and evicted as usual.
+  for i := 0; i < 20; i++ {
+    var key *Slice = NewSlice(EncodeKey(100+i))
+    shard.Release(shard.InsertEntry(key, Hash(key.data(), 0), 200+i, 1, Deleter,
+                                    &insertOptions{priority: CachePriorityHigh}))
+  }
+  ASSERT_EQ(10, int(shard.TotalCharge()))
+  ASSERT_LE(int(shard.high_pri_usage_), 5)
+  for i := 15; i < 20; i++ {
+    var key *Slice = NewSlice(EncodeKey(100+i))
+    var h CacheHandle = shard.Lookup(key, Hash(key.data(), 0))
+    ASSERT_EQ(200+i, DecodeValue(h.Value()))
+    shard.Release(h)
+  }
+}
+
+func TestCache_PruneTo(t *testing.T) {
+  var shard *LRUCache = ConstructLRUCache()
+  shard.SetCapacity(100)
+  current_deleted_keys = current_deleted_keys[:0]
+  current_deleted_values = current_deleted_values[:0]
+
+  var keys []*Slice
+  for k := 0; k < 10; k++ {
+    keys = append(keys, NewSlice(EncodeKey(k)))
+    shard.Release(shard.Insert(keys[k], Hash(keys[k].data(), 0), 100+k, 1, Deleter))
+  }
+  var h CacheHandle = shard.Lookup(keys[0], Hash(keys[0].data(), 0))
+
+  // Trims the coldest unpinned entries only.
+  shard.PruneTo(6)
+  ASSERT_EQ(6, int(shard.TotalCharge()))
+  ASSERT_EQ(4, len(current_deleted_keys))
+  for k := 0; k < 4; k++ {
+    ASSERT_EQ(k+1, current_deleted_keys[k])
+  }
+  ASSERT_EQ(0, int(shard.Stats().Evictions))
+
+  // Pinned entries stay even if that leaves usage above the target.
+  shard.PruneTo(0)
+  ASSERT_EQ(1, int(shard.TotalCharge()))
+  shard.Release(h)
+
+  var current_19 *CacheTest = ConstructCacheTest()
+  for i := 0; i < kCacheSize; i++ {
+    current_19.Insert(i, 1000+i, 1)
+  }
+  current_19.cache_.PruneTo(kCacheSize / 2)
+  ASSERT_LE(int(current_19.cache_.TotalCharge()), kCacheSize / 2)
+  ASSERT_LE(kCacheSize / 2 - kNumShards, int(current_19.cache_.TotalCharge()))
+}
+
+func TestCache_PruneToSmallCache(t *testing.T) {
+  for _, cache := range []Cache{NewLRUCache(kCacheSize), NewClockCache(kCacheSize)} {
+    for k := 0; k < 10; k++ {
+      cache.Release(cache.Insert(NewSlice(EncodeKey(k)), k, 1, func(*Slice, interface{}) {}))
+    }
+    // A target at or above usage leaves the cache alone.
+    cache.PruneTo(15)
+    ASSERT_EQ(10, int(cache.TotalCharge()))
+    cache.PruneTo(10)
+    ASSERT_EQ(10, int(cache.TotalCharge()))
+
+    for k := 10; k < 160; k++ {
+      cache.Release(cache.Insert(NewSlice(EncodeKey(k)), k, 1, func(*Slice, interface{}) {}))
+    }
+    ASSERT_EQ(160, int(cache.TotalCharge()))
+    cache.PruneTo(159)
+    ASSERT_EQ(159, int(cache.TotalCharge()))
+    cache.PruneTo(100)
+    ASSERT_EQ(100, int(cache.TotalCharge()))
+  }
+}
+
+func TestCache_PruneTargets(t *testing.T) {
+  var usage [kNumShards]uint64
+  usage[0] = 100
+  usage[3] = 50
+  usage[7] = 1
+  var targets [kNumShards]uint64 = pruneTargets(usage, 75)
+  var total uint64 = 0
+  for s := 0; s < kNumShards; s++ {
+    ASSERT_LE(int(targets[s]), int(usage[s]))
+    total += targets[s]
+  }
+  ASSERT_EQ(75, int(total))
+  // Proportional shares, with the unit lost to rounding taken from shard 0.
+  ASSERT_EQ(49, int(targets[0]))
+  ASSERT_EQ(25, int(targets[3]))
+  ASSERT_EQ(1, int(targets[7]))
+
+  ASSERT_EQ(int(usage[0]), int(pruneTargets(usage, 1000)[0]))
+  ASSERT_EQ(0, int(pruneTargets(usage, 0)[0]))
+}
+
+func TestCache_InsertOwnedKey(t *testing.T) {
+  var current_20 *CacheTest = ConstructCacheTest()
+  current_deleted_keys = current_deleted_keys[:0]
+  current_deleted_values = current_deleted_values[:0]
+
+  var buf []byte = EncodeKey(100)
+  var h CacheHandle = current_20.cache_.InsertOwnedKey(NewSlice(buf), 101, 1, Deleter)
+  if &h.(*LRUHandle).key_data[0] != &buf[0] {
+    panic("TestCache_InsertOwnedKey() error: key was copied")
+  }
+  current_20.cache_.Release(h)
+  ASSERT_EQ(101, current_20.Lookup(100))
+
+  // Once the entry is gone, its handle gets recycled without handing the
+  // caller's buffer to another entry.
+  current_20.Erase(100)
+  ASSERT_EQ(1, len(current_deleted_keys))
+  for i := 0; i < 100; i++ {
+    current_20.Insert(1000+i, 2000+i, 1)
+  }
+  ASSERT_EQ(100, DecodeKey(NewSlice(buf)))
+}
+
+func TestCache_CopyCacheEntries(t *testing.T) {
+  var current_21 *CacheTest = ConstructCacheTest()
+  current_deleted_keys = current_deleted_keys[:0]
+  current_deleted_values = current_deleted_values[:0]
+
+  for i := 0; i < 100; i++ {
+    current_21.Insert(i, 1000+i, 2)
+  }
+
+  var options LRUCacheOptions
+  options.Capacity = 2 * kCacheSize
+  options.ProtectedRatio = 0.5
+  var dst *CacheTest = new(CacheTest)
+  dst.cache_ = NewLRUCacheWithOptions(options)
+  ASSERT_EQ(100, CopyCacheEntries(dst.cache_, current_21.cache_, Deleter))
+  ASSERT_EQ(200, int(dst.cache_.TotalCharge()))
+  for i := 0; i < 100; i++ {
+    ASSERT_EQ(1000+i, dst.Lookup(i))
+  }
+
+  // Works across eviction policies too; the source is left untouched.
+  var clock *CacheTest = new(CacheTest)
+  clock.cache_ = NewClockCache(kCacheSize)
+  ASSERT_EQ(100, CopyCacheEntries(clock.cache_, current_21.cache_, Deleter))
+  ASSERT_EQ(1050, clock.Lookup(50))
+  ASSERT_EQ(1050, current_21.Lookup(50))
+  ASSERT_EQ(0, len(current_deleted_keys))
+
+  // From an LRU cache, entries are copied coldest first, so the copy keeps
+  // their recency order.
+  for i := 0; i < 50; i++ {
+    current_21.Lookup(i)
+  }
+  var ordered *ShardedLRUCache = ConstructShardedLRUCache(2 * kCacheSize)
+  ASSERT_EQ(100, CopyCacheEntries(ordered, current_21.cache_, Deleter))
+  for s := 0; s < kNumShards; s++ {
+    var seen_hot bool = false
+    ordered.shard_[s].ApplyToAllKeysInLRUOrder(func(key *Slice) {
+      var hot bool = DecodeKey(key) < 50
+      if seen_hot && !hot {
+        panic("TestCache_CopyCacheEntries() error")
+      }
+      seen_hot = seen_hot || hot
+    })
+  }
+}
+
+func TestCache_StrictCapacityLimit(t *testing.T) {
+  var shard *LRUCache = ConstructLRUCache()
+  shard.SetCapacity(5)
+  shard.SetStrictCapacityLimit(true)
+  current_deleted_keys = current_deleted_keys[:0]
+  current_deleted_values = current_deleted_values[:0]
+
+  var handles []CacheHandle
+  for k := 0; k < 5; k++ {
+    var key *Slice = NewSlice(EncodeKey(k))
+    handles = append(handles, shard.Insert(key, Hash(key.data(), 0), 100+k, 1, Deleter))
+  }
+  ASSERT_EQ(5, int(shard.TotalCharge()))
+
+  // Everything is pinned: a failing insert leaves the cache untouched.
+  var key *Slice = NewSlice(EncodeKey(5))
+  var opts = insertOptions{fail_if_full: true}
+  var h CacheHandle = shard.InsertEntry(key, Hash(key.data(), 0), 105, 1, Deleter, &opts)
+  if h != nil {
+    panic("TestCache_StrictCapacityLimit() error")
+  }
+  ASSERT_EQ(5, int(shard.TotalCharge()))
+  ASSERT_EQ(0, len(current_deleted_keys))
+
+  // A plain Insert hands back an entry that is not cached.
+  h = shard.Insert(key, Hash(key.data(), 0), 105, 1, Deleter)
+  ASSERT_EQ(105, DecodeValue(h.Value()))
+  ASSERT_EQ(5, int(shard.TotalCharge()))
+  shard.Release(h)
+  ASSERT_EQ(1, len(current_deleted_keys))
+  if _, ok := shard.Peek(key, Hash(key.data(), 0)); ok {
+    panic("TestCache_StrictCapacityLimit() error")
+  }
+
+  // Releasing a handle makes room again.
+  shard.Release(handles[0])
+  h = shard.InsertEntry(key, Hash(key.data(), 0), 105, 1, Deleter, &opts)
+  if h == nil {
+    panic("TestCache_StrictCapacityLimit() error")
+  }
+  ASSERT_EQ(5, int(shard.TotalCharge()))
+  shard.Release(h)
+  for k := 1; k < 5; k++ {
+    shard.Release(handles[k])
+  }
+
+  // Through the Cache interface.
+  var options LRUCacheOptions
+  options.Capacity = kNumShards
+  options.StrictCapacityLimit = true
+  var cache Cache = NewLRUCacheWithOptions(options)
+  var pinned []CacheHandle
+  var failed int = 0
+  for k := 0; k < 4*kNumShards; k++ {
+    h, err := cache.TryInsert(NewSlice(EncodeKey(k)), k, 1, Deleter)
+    if err == ErrCacheFull {
+      failed++
+      continue
+    }
+    pinned = append(pinned, h)
+  }
+  ASSERT_LE(int(cache.TotalCharge()), kNumShards)
+  ASSERT_EQ(len(pinned), int(cache.TotalCharge()))
+  ASSERT_EQ(4*kNumShards, len(pinned) + failed)
+  for _, h := range pinned {
+    cache.Release(h)
+  }
+}
+
+func TestCache_SaveKeysAndWarmUp(t *testing.T) {
+  var current_22 *CacheTest = ConstructCacheTest()
+  current_deleted_keys = current_deleted_keys[:0]
+  current_deleted_values = current_deleted_values[:0]
+
+  for i := 0; i < 100; i++ {
+    current_22.Insert(i, 1000+i, 1)
+  }
+  var h CacheHandle = current_22.cache_.Lookup(NewSlice(EncodeKey(7)))
+
+  var saved bytes.Buffer
+  if err := current_22.cache_.(*ShardedLRUCache).SaveKeys(&saved); err != nil {
+    panic("TestCache_SaveKeysAndWarmUp() error")
+  }
+  current_22.cache_.Release(h)
+
+  // Warm up a fresh cache; key 13 can no longer be loaded.
+  var restarted *CacheTest = ConstructCacheTest()
+  var loader = func(key *Slice) (interface{}, uint64, error) {
+    var k int = DecodeKey(key)
+    if k == 13 {
+      return nil, 0, errors.New("gone")
+    }
+    return 1000 + k, 1, nil
+  }
+  n, err := restarted.cache_.(*ShardedLRUCache).WarmUp(&saved, loader, Deleter)
+  if err != nil {
+    panic("TestCache_SaveKeysAndWarmUp() error")
+  }
+  ASSERT_EQ(99, n)
+  for i := 0; i < 100; i++ {
+    if i == 13 {
+      ASSERT_EQ(-1, restarted.Lookup(i))
+    } else {
+      ASSERT_EQ(1000+i, restarted.Lookup(i))
+    }
+  }
+
+  // Truncated input is reported.
+  var truncated *bytes.Buffer = bytes.NewBuffer([]byte{4, 'a', 'b'})
+  _, err = restarted.cache_.(*ShardedLRUCache).WarmUp(truncated, loader, Deleter)
+  if err != io.ErrUnexpectedEOF {
+    panic("TestCache_SaveKeysAndWarmUp() error")
+  }
+}
+
+func TestCache_ShardStats(t *testing.T) {
+  var current_23 *CacheTest = ConstructCacheTest()
+  current_deleted_keys = current_deleted_keys[:0]
+  current_deleted_values = current_deleted_values[:0]
+
+  for i := 0; i < 100; i++ {
+    current_23.Insert(i, 1000+i, 2)
+  }
+  for i := 0; i < 150; i++ {
+    current_23.Lookup(i)
+  }
+
+  var sharded *ShardedLRUCache = current_23.cache_.(*ShardedLRUCache)
+  var stats []CacheShardStats = sharded.ShardStats()
+  ASSERT_EQ(kNumShards, len(stats))
+  var usage, entries, hits, misses uint64
+  for s := 0; s < kNumShards; s++ {
+    usage += stats[s].Usage
+    entries += stats[s].Entries
+    hits += stats[s].Hits
+    misses += stats[s].Misses
+    ASSERT_EQ(int(2 * stats[s].Entries), int(stats[s].Usage))
+  }
+  ASSERT_EQ(200, int(usage))
+  ASSERT_EQ(100, int(entries))
+  ASSERT_EQ(100, int(hits))
+  ASSERT_EQ(50, int(misses))
+
+  // All lookups of one key land on one shard.
+  var key *Slice = NewSlice(EncodeKey(7))
+  var shard uint32 = sharded.Shard(sharded.HashSlice(key))
+  var before uint64 = sharded.ShardStats()[shard].Hits
+  for i := 0; i < 10; i++ {
+    current_23.Lookup(7)
+  }
+  ASSERT_EQ(int(before + 10), int(sharded.ShardStats()[shard].Hits))
+}
+
+func TestCache_DebugHandles(t *testing.T) {
+  current_deleted_keys = current_deleted_keys[:0]
+  current_deleted_values = current_deleted_values[:0]
+  var options LRUCacheOptions
+  options.Capacity = kCacheSize
+  options.DebugHandles = true
+  var cache *ShardedLRUCache = ConstructShardedLRUCacheWithOptions(options)
+
+  var h1 CacheHandle = cache.Insert(NewSlice(EncodeKey(1)), 101, 1, Deleter)
+  var h2 CacheHandle = cache.Lookup(NewSlice(EncodeKey(1)))
+  cache.Release(cache.Insert(NewSlice(EncodeKey(2)), 102, 1, Deleter))
+
+  var handles []OutstandingHandle = cache.OutstandingHandles()
+  ASSERT_EQ(2, len(handles))
+  for _, h := range handles {
+    if !bytes.Equal(EncodeKey(1), h.Key) {
+      panic("TestCache_DebugHandles() error")
+    }
+    if !strings.Contains(h.Stack, "TestCache_DebugHandles") {
+      panic("TestCache_DebugHandles() error")
+    }
+  }
+  cache.Release(h2)
+  ASSERT_EQ(1, len(cache.OutstandingHandles()))
+  cache.Release(h1)
+  ASSERT_EQ(0, len(cache.OutstandingHandles()))
+
+  // Without the option nothing is tracked.
+  var plain *ShardedLRUCache = ConstructShardedLRUCache(kCacheSize)
+  var h CacheHandle = plain.Insert(NewSlice(EncodeKey(3)), 103, 1, Deleter)
+  ASSERT_EQ(0, len(plain.OutstandingHandles()))
+  plain.Release(h)
+
+  // Destroying a shard with a leaked handle names the culprit.
+  var shard *LRUCache = ConstructLRUCache()
+  shard.SetCapacity(kCacheSize)
+  shard.SetDebugHandles(true)
+  var key *Slice = NewSlice(EncodeKey(4))
+  shard.Insert(key, Hash(key.data(), 0), 104, 1, Deleter)
+  var msg string
+  func() {
+    defer func() { msg = fmt.Sprint(recover()) }()
+    shard.DestructLRUCache()
+  }()
+  if !strings.Contains(msg, "unreleased handles") {
+    panic("TestCache_DebugHandles() error")
+  }
+  if !strings.Contains(msg, "TestCache_DebugHandles") {
+    panic("TestCache_DebugHandles() error")
+  }
+}
+
+func TestCache_ErasePrefix(t *testing.T) {
+  var current_24 *CacheTest = ConstructCacheTest()
+  current_deleted_keys = current_deleted_keys[:0]
+  current_deleted_values = current_deleted_values[:0]
+
+  // Keys are little-endian, so the first byte is the low byte: keys with
+  // the low byte 7 share the prefix {7}.
+  for j := 0; j < 10; j++ {
+    current_24.Insert(j * 256 + 7, j, 1)
+    current_24.Insert(j * 256 + 8, j, 1)
+  }
+  var h CacheHandle = current_24.cache_.Lookup(NewSlice(EncodeKey(3 * 256 + 7)))
+
+  current_24.cache_.ErasePrefix(NewSlice([]byte{7}))
+  ASSERT_EQ(9, len(current_deleted_keys))  // The pinned entry is still alive.
+  ASSERT_EQ(10, int(current_24.cache_.TotalCharge()))
+  for j := 0; j < 10; j++ {
+    ASSERT_EQ(-1, current_24.Lookup(j * 256 + 7))
+    ASSERT_EQ(j, current_24.Lookup(j * 256 + 8))
+  }
+  ASSERT_EQ(3, DecodeValue(current_24.cache_.Value(h)))
+  current_24.cache_.Release(h)
+  ASSERT_EQ(10, len(current_deleted_keys))
+
+  // An empty prefix matches everything.
+  current_24.cache_.ErasePrefix(NewSlice(nil))
+  ASSERT_EQ(20, len(current_deleted_keys))
+  ASSERT_EQ(0, int(current_24.cache_.TotalCharge()))
+}
+
+type sizedValue struct {
+  size uint64
+}
+
+func (v *sizedValue) Charge() uint64 {
+  return v.size
+}
+
+func TestCache_AutoCharge(t *testing.T) {
+  var options LRUCacheOptions
+  options.Capacity = kCacheSize
+  options.Sizer = func(value interface{}) uint64 { return uint64(len(value.(string))) }
+  var cache Cache = NewLRUCacheWithOptions(options)
+  var noop = func(*Slice, interface{}) {}
+
+  cache.Release(cache.Insert(NewSlice(EncodeKey(1)), &sizedValue{7}, AutoCharge, noop))
+  ASSERT_EQ(7, int(cache.TotalCharge()))
+  cache.Release(cache.Insert(NewSlice(EncodeKey(2)), "hello", AutoCharge, noop))
+  ASSERT_EQ(12, int(cache.TotalCharge()))
+  // An explicit charge is used as given.
+  cache.Release(cache.Insert(NewSlice(EncodeKey(3)), &sizedValue{7}, 3, noop))
+  ASSERT_EQ(15, int(cache.TotalCharge()))
+
+  // The CLOCK cache only understands Sizer values.
+  var clock Cache = NewClockCache(kCacheSize)
+  clock.Release(clock.Insert(NewSlice(EncodeKey(1)), &sizedValue{9}, AutoCharge, noop))
+  ASSERT_EQ(9, int(clock.TotalCharge()))
+  func() {
+    defer func() {
+      if recover() == nil {
+        panic("TestCache_AutoCharge() error")
+      }
+    }()
+    clock.Insert(NewSlice(EncodeKey(2)), "hello", AutoCharge, noop)
+  }()
+}
+
+func TestCache_RoleStats(t *testing.T) {
+  for _, cache := range []Cache{NewLRUCache(kCacheSize), NewClockCache(kCacheSize)} {
+    var noop = func(*Slice, interface{}) {}
+    for i := 0; i < 10; i++ {
+      cache.Release(cache.InsertWithRole(NewSlice(EncodeKey(i)), i, 2, CacheEntryRoleIndexBlock, noop))
+      cache.Release(cache.InsertWithRole(NewSlice(EncodeKey(100+i)), i, 3, CacheEntryRoleDataBlock, noop))
+    }
+    cache.Release(cache.Insert(NewSlice(EncodeKey(200)), 200, 1, noop))
+    for i := 0; i < 4; i++ {
+      cache.Release(cache.Lookup(NewSlice(EncodeKey(i))))
+    }
+    cache.Release(cache.Lookup(NewSlice(EncodeKey(100))))
+
+    var stats CacheStats = cache.Stats()
+    ASSERT_EQ(20, int(stats.Roles[CacheEntryRoleIndexBlock].Usage))
+    ASSERT_EQ(30, int(stats.Roles[CacheEntryRoleDataBlock].Usage))
+    ASSERT_EQ(1, int(stats.Roles[CacheEntryRoleOther].Usage))
+    ASSERT_EQ(0, int(stats.Roles[CacheEntryRoleFilterBlock].Usage))
+    ASSERT_EQ(4, int(stats.Roles[CacheEntryRoleIndexBlock].Hits))
+    ASSERT_EQ(1, int(stats.Roles[CacheEntryRoleDataBlock].Hits))
+
+    // Erased and pruned entries no longer count.
+    cache.Erase(NewSlice(EncodeKey(0)))
+    ASSERT_EQ(18, int(cache.Stats().Roles[CacheEntryRoleIndexBlock].Usage))
+    cache.Prune()
+    stats = cache.Stats()
+    for r := 0; r < kNumCacheEntryRoles; r++ {
+      ASSERT_EQ(0, int(stats.Roles[r].Usage))
+    }
+  }
+}
+
+func TestCache_DeleterKeepsKey(t *testing.T) {
+  // A deleter may keep the key it is passed; recycling the handle must not
+  // overwrite it.
+  var kept []*Slice
+  var deleter = func(key *Slice, v interface{}) {
+    kept = append(kept, key)
+  }
+  var cache Cache = NewLRUCache(kNumShards)
+  for k := 0; k < 1000; k++ {
+    cache.Release(cache.Insert(NewSlice(EncodeKey(k)), k, 1, deleter))
+  }
+  cache.Prune()
+  ASSERT_EQ(1000, len(kept))
+  var seen = make(map[int]bool)
+  for _, key := range kept {
+    seen[DecodeKey(key)] = true
+  }
+  ASSERT_EQ(1000, len(seen))
+}
+
+func TestCache_HitLogOverflow(t *testing.T) {
+  const kEntries = 3 * kHitLogSize
+  var shard *LRUCache = ConstructLRUCache()
+  shard.SetCapacity(kEntries)
+  current_deleted_keys = current_deleted_keys[:0]
+  current_deleted_values = current_deleted_values[:0]
+  var keys [kEntries]*Slice
+  for k := 0; k < kEntries; k++ {
+    keys[k] = NewSlice(EncodeKey(k))
+    shard.Release(shard.Insert(keys[k], Hash(keys[k].data(), 0), 100+k, 1, Deleter))
+  }
+
+  // Far more hits than the log holds, with no write in between: the
+  // lookups past the end of the log fall back to the write lock.
+  for k := kEntries - 1; k >= 0; k-- {
+    var h CacheHandle = shard.Lookup(keys[k], Hash(keys[k].data(), 0))
+    ASSERT_EQ(100+k, DecodeValue(h.Value()))
+    shard.Release(h)
+  }
+  ASSERT_EQ(kEntries, int(shard.Stats().Hits))
+
+  // Every hit was applied, in the order it happened.
+  var order []int
+  shard.ApplyToAllKeysInLRUOrder(func(key *Slice) {
+    order = append(order, DecodeKey(key))
+  })
+  ASSERT_EQ(kEntries, len(order))
+  for i := 0; i < kEntries; i++ {
+    ASSERT_EQ(kEntries - 1 - i, order[i])
+  }
+  // Which the next eviction follows.
+  var key *Slice = NewSlice(EncodeKey(kEntries))
+  shard.Release(shard.Insert(key, Hash(key.data(), 0), 100+kEntries, 1, Deleter))
+  ASSERT_EQ(1, len(current_deleted_keys))
+  ASSERT_EQ(kEntries - 1, current_deleted_keys[0])
+}
+
+func TestCache_ConcurrentStress(t *testing.T) {
+  const kThreads = 8
+  const kOpsPerThread = 20000
+  const kKeys = 512
+
+  for _, ratio := range []float64{0, 0.5} {
+    var options LRUCacheOptions
+    options.Capacity = kKeys / 4
+    options.ProtectedRatio = ratio
+    var cache Cache = NewLRUCacheWithOptions(options)
+
+    // Every insert gets its own value, so that each deleter call can be
+    // told apart.
+    var next_value int32
+    var deleted [kThreads * kOpsPerThread]int32
+    var deleter = func(key *Slice, v interface{}) {
+      atomic.AddInt32(&deleted[DecodeValue(v)], 1)
+    }
+
+    var wg sync.WaitGroup
+    for i := 0; i < kThreads; i++ {
+      wg.Add(1)
+      go func(seed int64) {
+        defer wg.Done()
+        var r *rand.Rand = rand.New(rand.NewSource(seed))
+        for op := 0; op < kOpsPerThread; op++ {
+          var key *Slice = NewSlice(EncodeKey(r.Intn(kKeys)))
+          switch n := r.Intn(100); {
+          case n < 30:
+            var value int = int(atomic.AddInt32(&next_value, 1) - 1)
+            cache.Release(cache.Insert(key, value, 1, deleter))
+          case n < 80:
+            if h := cache.Lookup(key); h != nil {
+              cache.Release(h)
+            }
+          case n < 90:
+            // Two handles to the same entry at once.
+            if h := cache.Lookup(key); h != nil {
+              if h2 := cache.Lookup(key); h2 != nil {
+                cache.Release(h2)
+              }
+              cache.Release(h)
+            }
+          case n < 98:
+            cache.Erase(key)
+          default:
+            cache.PruneTo(uint64(r.Intn(kKeys / 4)))
+          }
+        }
+      }(int64(i + 1))
+    }
+    wg.Wait()
+
+    cache.Prune()
+    ASSERT_EQ(0, int(cache.TotalCharge()))
+    for v := 0; v < int(next_value); v++ {
+      if deleted[v] != 1 {
+        panic("TestCache_ConcurrentStress() error")
+      }
+    }
+  }
+}
+
+func TestCache_MissReturnsNilHandle(t *testing.T) {
+  for _, cache := range []Cache{NewLRUCache(kCacheSize), NewClockCache(kCacheSize)} {
+    if cache.Lookup(NewSlice(EncodeKey(1))) != nil {
+      panic("TestCache_MissReturnsNilHandle() error")
+    }
+    var h CacheHandle = cache.Insert(NewSlice(EncodeKey(1)), 101, 1, func(*Slice, interface{}) {})
+    ASSERT_EQ(101, DecodeValue(h.Value()))
+    ASSERT_EQ(101, DecodeValue(cache.Value(h)))
+    cache.Release(h)
+  }
+}
+
+func BenchmarkCache_Insert(b *testing.B) {
+  var cache Cache = NewLRUCache(kCacheSize)
+  var keys []*Slice
+  for i := 0; i < 4*kCacheSize; i++ {
+    keys = append(keys, NewSlice(EncodeKey(i)))
+  }
+  var deleter = func(*Slice, interface{}) {}
+
+  b.ReportAllocs()
+  b.ResetTimer()
+  for i := 0; i < b.N; i++ {
+    cache.Release(cache.Insert(keys[i % len(keys)], nil, 1, deleter))
+  }
+}
+
+func BenchmarkCache_InsertOwnedKey(b *testing.B) {
+  var cache Cache = NewLRUCache(kCacheSize)
+  var keys []*Slice
+  for i := 0; i < 4*kCacheSize; i++ {
+    keys = append(keys, NewSlice(EncodeKey(i)))
+  }
+  var deleter = func(*Slice, interface{}) {}
+
+  b.ReportAllocs()
+  b.ResetTimer()
+  for i := 0; i < b.N; i++ {
+    cache.Release(cache.InsertOwnedKey(keys[i % len(keys)], nil, 1, deleter))
+  }
+}
+
+func BenchmarkCache_Lookup(b *testing.B) {
+  var cache Cache = NewLRUCache(kCacheSize * kNumShards)
+  var keys []*Slice
+  for i := 0; i < kCacheSize; i++ {
+    keys = append(keys, NewSlice(EncodeKey(i)))
+    cache.Release(cache.Insert(keys[i], i, 1, func(*Slice, interface{}) {}))
+  }
+
+  b.ReportAllocs()
+  b.ResetTimer()
+  for i := 0; i < b.N; i++ {
+    cache.Release(cache.Lookup(keys[i % kCacheSize]))
+  }
+}
+
+func BenchmarkCache_ConcurrentLookup(b *testing.B) {
+  var cache Cache = NewLRUCache(kCacheSize * kNumShards)
+  var keys []*Slice
+  for i := 0; i < kCacheSize; i++ {
+    keys = append(keys, NewSlice(EncodeKey(i)))
+    cache.Release(cache.Insert(keys[i], i, 1, func(*Slice, interface{}) {}))
+  }
+
+  b.ReportAllocs()
+  b.ResetTimer()
+  b.RunParallel(func(pb *testing.PB) {
+    var i int = 0
+    for pb.Next() {
+      cache.Release(cache.Lookup(keys[i % kCacheSize]))
+      i++
+    }
+  })
+}
+
+// All goroutines hit the same handful of keys, and hence the same shards.
+func BenchmarkCache_ConcurrentHotLookup(b *testing.B) {
+  var cache Cache = NewLRUCache(kCacheSize * kNumShards)
+  var keys []*Slice
+  for i := 0; i < 4; i++ {
+    keys = append(keys, NewSlice(EncodeKey(i)))
+    cache.Release(cache.Insert(keys[i], i, 1, func(*Slice, interface{}) {}))
+  }
+
+  b.ReportAllocs()
+  b.ResetTimer()
+  b.RunParallel(func(pb *testing.PB) {
+    var i int = 0
+    for pb.Next() {
+      cache.Release(cache.Lookup(keys[i % len(keys)]))
+      i++
+    }
+  })
+}
+
+// One insert for every nine lookups.
+func BenchmarkCache_ConcurrentLookupInsert(b *testing.B) {
+  var cache Cache = NewLRUCache(kCacheSize * kNumShards)
+  var keys []*Slice
+  for i := 0; i < kCacheSize; i++ {
+    keys = append(keys, NewSlice(EncodeKey(i)))
+    cache.Release(cache.Insert(keys[i], i, 1, func(*Slice, interface{}) {}))
+  }
+
+  b.ReportAllocs()
+  b.ResetTimer()
+  b.RunParallel(func(pb *testing.PB) {
+    var i int = 0
+    for pb.Next() {
+      var key *Slice = keys[i % kCacheSize]
+      if i % 10 == 0 {
+        cache.Release(cache.Insert(key, i, 1, func(*Slice, interface{}) {}))
+      } else if h := cache.Lookup(key); h != nil {
+        cache.Release(h)
+      }
+      i++
+    }
+  })
+}
@@ -0,0 +1,519 @@
+// Copyright (c) 2016 Hong Xiaodong. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+// CLOCK cache implementation
+//
+// A CLOCK (second-chance) cache approximates LRU without reordering
+// entries on every access.  Entries sit on a circular list in insertion
+// order and carry a "visited" bit that Lookup() sets.  To make room, the
+// clock hand sweeps the list: an entry with the bit set gets a second
+// chance (the bit is cleared and the hand moves on), an entry without it
+// that is not referenced by any client is evicted.
+//
+// Because Lookup() never touches the list, it only needs a read lock on
+// the shard; reference counts and visited bits are updated atomically.
+// Release() needs no lock at all.  This suits read-heavy workloads where
+// the LRU list manipulation under a mutex dominates.
+//
+// Entries use the same LRUHandle structure and HandleTable as the LRU
+// cache.  The cache holds one reference on every entry it contains, so an
+// entry is passed to its deleter exactly when its reference count drops
+// to zero, whichever of Release(), Erase() or eviction gets there last.
+
+package util
+
+import (
+  "sync"
+  "sync/atomic"
+  "time"
+)
+
+// Create a new cache with a fixed size capacity.  This implementation
+// of Cache uses a CLOCK (second-chance) eviction policy.
+func NewClockCache(capacity uint64) Cache {
+  return ConstructShardedClockCache(capacity)
+}
+
+// A single shard of sharded clock cache.
+type ClockCache struct {
+  // Statistics, updated atomically so Stats() does not need mutex_.
+  // Kept first in the struct so they are 64-bit aligned.
+  hits_      uint64
+  misses_    uint64
+  inserts_   uint64
+  evictions_ uint64
+  role_hits_ [kNumCacheEntryRoles]uint64
+
+  capacity_ uint64        // Initialized before use.
+  mutex_    sync.RWMutex  // mutex_ protects the following state.
+  usage_    uint64
+  role_usage_ [kNumCacheEntryRoles]uint64  // usage_ by CacheEntryRole.
+
+  // Dummy head of the clock ring.  Entries are appended just before
+  // the hand, i.e. they are examined last by the next sweep.
+  // Entries have in_cache==true and refs >= 1.
+  ring_     LRUHandle
+  hand_     *LRUHandle    // Next entry the clock hand examines.
+  table_    HandleTable
+
+  strict_capacity_limit_ bool
+}
+
+func ConstructClockCache() *ClockCache {
+  var ret = new(ClockCache)
+  ret.ring_.next = &ret.ring_
+  ret.ring_.prev = &ret.ring_
+  ret.hand_ = &ret.ring_
+  ret.table_ = ConstructHandleTable()
+  return ret
+}
+
+func (s *ClockCache) SetCapacity(capacity uint64) {
+  s.mutex_.Lock()
+  s.capacity_ = capacity
+  s.EvictToCapacity()
+  s.mutex_.Unlock()
+}
+
+func (s *ClockCache) SetStrictCapacityLimit(strict bool) {
+  s.mutex_.Lock()
+  s.strict_capacity_limit_ = strict
+  s.mutex_.Unlock()
+}
+
+func (s *ClockCache) Unref(e *LRUHandle) {
+  var refs uint32 = atomic.AddUint32(&e.refs, ^uint32(0))
+  if refs == ^uint32(0) {
+    panic("ClockCache Unref() error")
+  }
+  if refs == 0 {  // Deallocate.
+    e.deleter(e.key(), e.value)
+    FreeLRUHandle(e)
+  }
+}
+
+func (s *ClockCache) Ring_Remove(e *LRUHandle) {
+  if s.hand_ == e {
+    s.hand_ = e.next
+  }
+  e.next.prev = e.prev
+  e.prev.next = e.next
+}
+
+func (s *ClockCache) Ring_Append(e *LRUHandle) {
+  // Insert "e" just before the hand.
+  var hand *LRUHandle = s.hand_
+  e.next = hand
+  e.prev = hand.prev
+  e.prev.next = e
+  e.next.prev = e
+}
+
+func (s *ClockCache) Lookup(key *Slice, hash uint32) CacheHandle {
+  s.mutex_.RLock()
+  var e *LRUHandle = s.table_.Lookup(key, hash)
+  if e != nil && e.expired() {
+    s.mutex_.RUnlock()
+    // Removing the stale entry requires the write lock.
+    s.mutex_.Lock()
+    e = s.table_.Lookup(key, hash)
+    if e != nil && e.expired() {
+      s.FinishErase(s.table_.Remove(key, hash))
+    }
+    s.mutex_.Unlock()
+    atomic.AddUint64(&s.misses_, 1)
+    return nil
+  }
+  if e != nil {
+    // The cache's own reference keeps e alive while we hold the read lock.
+    atomic.AddUint32(&e.refs, 1)
+    if atomic.LoadUint32(&e.visited) == 0 {
+      atomic.StoreUint32(&e.visited, 1)
+    }
+    atomic.AddUint64(&s.hits_, 1)
+    atomic.AddUint64(&s.role_hits_[e.role], 1)
+  } else {
+    atomic.AddUint64(&s.misses_, 1)
+    s.mutex_.RUnlock()
+    return nil
+  }
+  s.mutex_.RUnlock()
+  return e
+}
+
+func (s *ClockCache) Peek(key *Slice, hash uint32) (interface{}, bool) {
+  s.mutex_.RLock()
+  defer s.mutex_.RUnlock()
+  var e *LRUHandle = s.table_.Lookup(key, hash)
+  if e == nil || e.expired() {
+    return nil, false
+  }
+  return e.value, true
+}
+
+func (s *ClockCache) Release(handle CacheHandle) {
+  s.Unref(handle.(*LRUHandle))
+}
+
+func (s *ClockCache) InsertWithTTL(key *Slice, hash uint32, value interface{},
+                                   charge uint64, ttl time.Duration,
+                                   deleter LRUHandleDeleter) CacheHandle {
+  return s.InsertEntry(key, hash, value, charge, deleter, &insertOptions{ttl: ttl})
+}
+
+func (s *ClockCache) InsertEntry(key *Slice, hash uint32, value interface{},
+                                 charge uint64, deleter LRUHandleDeleter,
+                                 opts *insertOptions) CacheHandle {
+  var expire_at int64 = 0
+  if opts.ttl > 0 {
+    expire_at = time.Now().Add(opts.ttl).UnixNano()
+  }
+
+  charge = chargeFor(value, charge, nil)
+  s.mutex_.Lock()
+  atomic.AddUint64(&s.inserts_, 1)
+
+  var cache bool = s.capacity_ > 0
+  if cache && s.strict_capacity_limit_ && !s.MakeRoom(charge) {
+    if opts.fail_if_full {
+      s.mutex_.Unlock()
+      return nil
+    }
+    cache = false
+  }
+
+  var e *LRUHandle = NewLRUHandle()
+  e.value = value
+  e.deleter = deleter
+  e.charge = charge
+  e.key_length = key.size()
+  e.hash = hash
+  e.expire_at = expire_at
+  e.role = opts.role
+  e.in_cache = false
+  e.refs = 1  // for the returned handle.
+  if opts.priority == CachePriorityHigh {
+    e.visited = 1
+  }
+  if opts.owned_key {
+    e.key_data = key.data()
+  } else {
+    e.key_data = append(e.key_data, key.data() ...)
+  }
+
+  if cache {
+    e.refs++  // for the cache's reference.
+    e.in_cache = true
+    s.Ring_Append(e)
+    s.usage_ += charge
+    s.role_usage_[e.role] += charge
+    s.FinishErase(s.table_.Insert(e))
+  } // else don't cache.  (Tests use capacity_==0 to turn off caching.)
+
+  s.EvictToCapacity()
+
+  s.mutex_.Unlock()
+  return e
+}
+
+// Evict entries not in use until "charge" more fits in capacity_.
+// Return false if it cannot be made to fit.  Requires mutex_ held for writing.
+func (s *ClockCache) MakeRoom(charge uint64) bool {
+  if charge > s.capacity_ {
+    return false
+  }
+  s.EvictUntil(s.capacity_ - charge, EvictionCapacity)
+  return s.usage_ + charge <= s.capacity_
+}
+
+func (s *ClockCache) EvictToCapacity() {
+  s.EvictUntil(s.capacity_, EvictionCapacity)
+}
+
+// Sweep the clock hand until usage_ <= limit, or until two full rotations
+// found nothing evictable (everything is pinned).  Requires mutex_ held
+// for writing.
+func (s *ClockCache) EvictUntil(limit uint64, reason EvictionReason) {
+  var budget uint32 = 2 * (s.table_.elems_ + 1)
+  for s.usage_ > limit && budget > 0 {
+    budget--
+    var e *LRUHandle = s.hand_
+    if e == &s.ring_ {
+      s.hand_ = e.next
+      continue
+    }
+    s.hand_ = e.next
+    if atomic.LoadUint32(&e.refs) != 1 {
+      continue  // In use by a client.
+    }
+    if atomic.LoadUint32(&e.visited) != 0 {
+      atomic.StoreUint32(&e.visited, 0)  // Second chance.
+      continue
+    }
+    var erased bool = s.FinishErase(s.table_.Remove(e.key(), e.hash))
+    if !erased {
+      panic("ClockCache EvictUntil() error")
+    }
+    if reason == EvictionCapacity {
+      atomic.AddUint64(&s.evictions_, 1)
+    }
+  }
+}
+
+// If e != NULL, finish removing *e from the cache; it has already been removed
+// from the hash table.  Return whether e != NULL.  Requires mutex_ held for
+// writing.
+func (s *ClockCache) FinishErase(e *LRUHandle) bool {
+  if e != nil {
+    if !e.in_cache {
+      panic("ClockCache FinishErase() error")
+    }
+    s.Ring_Remove(e)
+    e.in_cache = false
+    s.usage_ -= e.charge
+    s.role_usage_[e.role] -= e.charge
+    s.Unref(e)
+  }
+  return e != nil
+}
+
+func (s *ClockCache) Erase(key *Slice, hash uint32) {
+  s.mutex_.Lock()
+  s.FinishErase(s.table_.Remove(key, hash))
+  s.mutex_.Unlock()
+}
+
+func (s *ClockCache) ErasePrefix(prefix *Slice) {
+  s.mutex_.Lock()
+  for _, e := range s.table_.MatchPrefix(prefix) {
+    s.FinishErase(s.table_.Remove(e.key(), e.hash))
+  }
+  s.mutex_.Unlock()
+}
+
+func (s *ClockCache) Prune() {
+  s.mutex_.Lock()
+  for e := s.ring_.next; e != &s.ring_; {
+    var next *LRUHandle = e.next
+    if atomic.LoadUint32(&e.refs) == 1 {
+      var erased bool = s.FinishErase(s.table_.Remove(e.key(), e.hash))
+      if !erased {
+        panic("ClockCache Prune() error")
+      }
+    }
+    e = next
+  }
+  s.mutex_.Unlock()
+}
+
+func (s *ClockCache) PruneTo(target uint64) {
+  s.mutex_.Lock()
+  s.EvictUntil(target, EvictionPrune)
+  s.mutex_.Unlock()
+}
+
+func (s *ClockCache) TotalCharge() uint64 {
+  s.mutex_.RLock()
+  var ret = s.usage_
+  s.mutex_.RUnlock()
+  return ret
+}
+
+func (s *ClockCache) ApplyToAllEntries(fn func(key *Slice, value interface{}, charge uint64)) {
+  s.mutex_.RLock()
+  s.table_.ApplyToAll(func(h *LRUHandle) {
+    fn(h.key(), h.value, h.charge)
+  })
+  s.mutex_.RUnlock()
+}
+
+func (s *ClockCache) Stats() CacheStats {
+  var stats CacheStats
+  stats.Hits = atomic.LoadUint64(&s.hits_)
+  stats.Misses = atomic.LoadUint64(&s.misses_)
+  stats.Inserts = atomic.LoadUint64(&s.inserts_)
+  stats.Evictions = atomic.LoadUint64(&s.evictions_)
+  s.mutex_.RLock()
+  stats.Usage = s.usage_
+  for r := 0; r < kNumCacheEntryRoles; r++ {
+    stats.Roles[r].Usage = s.role_usage_[r]
+  }
+  s.mutex_.RUnlock()
+  for r := 0; r < kNumCacheEntryRoles; r++ {
+    stats.Roles[r].Hits = atomic.LoadUint64(&s.role_hits_[r])
+  }
+  return stats
+}
+
+type ShardedClockCache struct {
+  shard_    [kNumShards]*ClockCache
+  loads_    [kNumShards]loadGroup
+  id_mutex_ sync.Mutex
+  last_id_  uint64
+}
+
+func (t *ShardedClockCache) HashSlice(s *Slice) uint32 {
+  return Hash(s.data(), 0)
+}
+
+func (t *ShardedClockCache) Shard(hash uint32) uint32 {
+  return hash >> (32 - kNumShardBits)
+}
+
+func ConstructShardedClockCache(capacity uint64) *ShardedClockCache {
+  var sclock *ShardedClockCache = new(ShardedClockCache)
+  sclock.last_id_ = 0
+  var per_shard uint64 = uint64((capacity + (kNumShards - 1)) / kNumShards)
+  for s := 0; s < kNumShards; s++ {
+    sclock.shard_[s] = ConstructClockCache()
+    sclock.shard_[s].SetCapacity(per_shard)
+  }
+  return sclock
+}
+
+func (t *ShardedClockCache) SetCapacity(capacity uint64) {
+  var per_shard uint64 = uint64((capacity + (kNumShards - 1)) / kNumShards)
+  for s := 0; s < kNumShards; s++ {
+    t.shard_[s].SetCapacity(per_shard)
+  }
+}
+
+func (t *ShardedClockCache) Insert(key *Slice, value interface{}, charge uint64, deleter LRUHandleDeleter) CacheHandle {
+  return t.InsertWithTTL(key, value, charge, 0, deleter)
+}
+
+func (t *ShardedClockCache) InsertWithTTL(key *Slice, value interface{}, charge uint64,
+                                          ttl time.Duration, deleter LRUHandleDeleter) CacheHandle {
+  var hash uint32 = t.HashSlice(key)
+  return t.shard_[t.Shard(hash)].InsertWithTTL(key, hash, value, charge, ttl, deleter)
+}
+
+func (t *ShardedClockCache) InsertWithPriority(key *Slice, value interface{}, charge uint64,
+                                               priority CachePriority, deleter LRUHandleDeleter) CacheHandle {
+  var hash uint32 = t.HashSlice(key)
+  var opts = insertOptions{priority: priority}
+  return t.shard_[t.Shard(hash)].InsertEntry(key, hash, value, charge, deleter, &opts)
+}
+
+func (t *ShardedClockCache) InsertWithRole(key *Slice, value interface{}, charge uint64,
+                                           role CacheEntryRole, deleter LRUHandleDeleter) CacheHandle {
+  var hash uint32 = t.HashSlice(key)
+  var opts = insertOptions{role: role}
+  return t.shard_[t.Shard(hash)].InsertEntry(key, hash, value, charge, deleter, &opts)
+}
+
+func (t *ShardedClockCache) InsertOwnedKey(key *Slice, value interface{}, charge uint64,
+                                           deleter LRUHandleDeleter) CacheHandle {
+  var hash uint32 = t.HashSlice(key)
+  var opts = insertOptions{owned_key: true}
+  return t.shard_[t.Shard(hash)].InsertEntry(key, hash, value, charge, deleter, &opts)
+}
+
+func (t *ShardedClockCache) SetStrictCapacityLimit(strict bool) {
+  for s := 0; s < kNumShards; s++ {
+    t.shard_[s].SetStrictCapacityLimit(strict)
+  }
+}
+
+func (t *ShardedClockCache) TryInsert(key *Slice, value interface{}, charge uint64,
+                                      deleter LRUHandleDeleter) (CacheHandle, error) {
+  var hash uint32 = t.HashSlice(key)
+  var opts = insertOptions{fail_if_full: true}
+  var h CacheHandle = t.shard_[t.Shard(hash)].InsertEntry(key, hash, value, charge, deleter, &opts)
+  if h == nil {
+    return nil, ErrCacheFull
+  }
+  return h, nil
+}
+
+func (t *ShardedClockCache) Lookup(key *Slice) CacheHandle {
+  var hash uint32 = t.HashSlice(key)
+  return t.shard_[t.Shard(hash)].Lookup(key, hash)
+}
+
+func (t *ShardedClockCache) GetOrInsert(key *Slice, charge uint64, loader func() (interface{}, error),
+                                        deleter LRUHandleDeleter) (CacheHandle, error) {
+  var hash uint32 = t.HashSlice(key)
+  return getOrInsert(t, &t.loads_[t.Shard(hash)], key, charge, loader, deleter)
+}
+
+func (t *ShardedClockCache) Peek(key *Slice) (interface{}, bool) {
+  var hash uint32 = t.HashSlice(key)
+  return t.shard_[t.Shard(hash)].Peek(key, hash)
+}
+
+func (t *ShardedClockCache) Release(handle CacheHandle) {
+  var h *LRUHandle = (handle).(*LRUHandle)
+  t.shard_[t.Shard(h.hash)].Release(handle)
+}
+
+func (t *ShardedClockCache) Erase(key *Slice) {
+  var hash uint32 = t.HashSlice(key)
+  t.shard_[t.Shard(hash)].Erase(key, hash)
+}
+
+func (t *ShardedClockCache) Value(handle CacheHandle) interface{} {
+  return handle.Value()
+}
+
+func (t *ShardedClockCache) ErasePrefix(prefix *Slice) {
+  for s := 0; s < kNumShards; s++ {
+    t.shard_[s].ErasePrefix(prefix)
+  }
+}
+
+func (t *ShardedClockCache) NewId() uint64 {
+  t.id_mutex_.Lock()
+  t.last_id_++
+  var ret = t.last_id_
+  t.id_mutex_.Unlock()
+  return ret
+}
+
+func (t *ShardedClockCache) Prune() {
+  for s := 0; s < kNumShards; s++ {
+    t.shard_[s].Prune()
+  }
+}
+
+func (t *ShardedClockCache) PruneTo(target uint64) {
+  var usage [kNumShards]uint64
+  for s := 0; s < kNumShards; s++ {
+    usage[s] = t.shard_[s].TotalCharge()
+  }
+  var targets [kNumShards]uint64 = pruneTargets(usage, target)
+  for s := 0; s < kNumShards; s++ {
+    if targets[s] < usage[s] {
+      t.shard_[s].PruneTo(targets[s])
+    }
+  }
+}
+
+func (t *ShardedClockCache) TotalCharge() uint64 {
+  var total uint64 = 0
+  for s := 0; s < kNumShards; s++ {
+    total += t.shard_[s].TotalCharge()
+  }
+  return total
+}
+
+func (t *ShardedClockCache) ApplyToAllEntries(fn func(key *Slice, value interface{}, charge uint64)) {
+  for s := 0; s < kNumShards; s++ {
+    t.shard_[s].ApplyToAllEntries(fn)
+  }
+}
+
+func (t *ShardedClockCache) Stats() CacheStats {
+  var total CacheStats
+  for s := 0; s < kNumShards; s++ {
+    var stats CacheStats = t.shard_[s].Stats()
+    total.Hits += stats.Hits
+    total.Misses += stats.Misses
+    total.Inserts += stats.Inserts
+    total.Evictions += stats.Evictions
+    total.Usage += stats.Usage
+    addRoleStats(&total, &stats)
+  }
+  return total
+}
@@ -0,0 +1,327 @@
+// Copyright (c) 2016 Hong Xiaodong. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package util
+
+import (
+  "sync"
+  "testing"
+  "time"
+)
+
+func ConstructClockCacheTest() *CacheTest {
+  var cache_test *CacheTest = new(CacheTest)
+  cache_test.cache_ = NewClockCache(kCacheSize)
+  current_deleted_keys   = current_deleted_keys[:0]
+  current_deleted_values = current_deleted_values[:0]
+  return cache_test
+}
+
+func TestClockCache_HitAndMiss(t *testing.T) {
+  var current_ *CacheTest = ConstructClockCacheTest()
+
+  ASSERT_EQ(-1, current_.Lookup(100))
+
+  current_.Insert(100, 101, 1)
+  ASSERT_EQ(101, current_.Lookup(100))
+  ASSERT_EQ(-1, current_.Lookup(200))
+
+  current_.Insert(200, 201, 1)
+  ASSERT_EQ(101, current_.Lookup(100))
+  ASSERT_EQ(201, current_.Lookup(200))
+
+  current_.Insert(100, 102, 1)
+  ASSERT_EQ(102, current_.Lookup(100))
+  ASSERT_EQ(201, current_.Lookup(200))
+
+  ASSERT_EQ(1, len(current_deleted_keys))
+  ASSERT_EQ(100, current_deleted_keys[0])
+  ASSERT_EQ(101, current_deleted_values[0])
+}
+
+func TestClockCache_Erase(t *testing.T) {
+  var current_ *CacheTest = ConstructClockCacheTest()
+
+  current_.Erase(200)
+  ASSERT_EQ(0, len(current_deleted_keys))
+
+  current_.Insert(100, 101, 1)
+  current_.Insert(200, 201, 1)
+  current_.Erase(100)
+  ASSERT_EQ(-1,  current_.Lookup(100))
+  ASSERT_EQ(201, current_.Lookup(200))
+  ASSERT_EQ(1,   len(current_deleted_keys))
+  ASSERT_EQ(100, current_deleted_keys[0])
+
+  current_.Erase(100)
+  ASSERT_EQ(1,   len(current_deleted_keys))
+}
+
+func TestClockCache_EntriesArePinned(t *testing.T) {
+  var current_ *CacheTest = ConstructClockCacheTest()
+
+  current_.Insert(100, 101, 1)
+  var h1 CacheHandle = current_.cache_.Lookup(NewSlice(EncodeKey(100)))
+  ASSERT_EQ(101, DecodeValue(current_.cache_.Value(h1)))
+
+  current_.Insert(100, 102, 1)
+  var h2 CacheHandle = current_.cache_.Lookup(NewSlice(EncodeKey(100)))
+  ASSERT_EQ(102, DecodeValue(current_.cache_.Value(h2)))
+  ASSERT_EQ(0, len(current_deleted_keys))
+
+  current_.cache_.Release(h1)
+  ASSERT_EQ(1, len(current_deleted_keys))
+  ASSERT_EQ(101, current_deleted_values[0])
+
+  current_.Erase(100)
+  ASSERT_EQ(-1, current_.Lookup(100))
+  ASSERT_EQ(1,  len(current_deleted_keys))
+
+  current_.cache_.Release(h2)
+  ASSERT_EQ(2, len(current_deleted_keys))
+  ASSERT_EQ(102, current_deleted_values[1])
+}
+
+func TestClockCache_EvictionPolicy(t *testing.T) {
+  var current_ *CacheTest = ConstructClockCacheTest()
+
+  current_.Insert(100, 101, 1)
+  current_.Insert(200, 201, 1)
+  current_.Insert(300, 301, 1)
+  var h CacheHandle = current_.cache_.Lookup(NewSlice(EncodeKey(300)))
+
+  // An entry that is used between sweeps gets a second chance and must
+  // be kept around, as must things that are still in use.  (Unlike LRU,
+  // CLOCK degrades to FIFO if every entry is used between sweeps, so the
+  // new entries are not looked up here.)
+  for i := 0; i < kCacheSize + 100; i++ {
+    current_.Insert(1000+i, 2000+i, 1)
+    ASSERT_EQ(101, current_.Lookup(100))
+  }
+  ASSERT_EQ(101, current_.Lookup(100))
+  ASSERT_EQ(-1,  current_.Lookup(200))
+  ASSERT_EQ(301, current_.Lookup(300))
+  current_.cache_.Release(h)
+}
+
+func TestClockCache_UseExceedsCacheSize(t *testing.T) {
+  var current_ *CacheTest = ConstructClockCacheTest()
+
+  var h []CacheHandle
+  for i := 0; i < kCacheSize + 100; i++ {
+    h = append(h, current_.InsertAndReturnHandle(1000+i, 2000+i, 1))
+  }
+  for i := 0; i < len(h); i++ {
+    ASSERT_EQ(2000+i, current_.Lookup(1000+i))
+  }
+  for i := 0; i < len(h); i++ {
+    current_.cache_.Release(h[i])
+  }
+}
+
+func TestClockCache_HeavyEntries(t *testing.T) {
+  var current_ *CacheTest = ConstructClockCacheTest()
+
+  const kLight  = int(1)
+  const kHeavy  = int(10)
+  var added int = 0
+  var index int = 0
+  for added < 2*kCacheSize {
+    var weight int = kHeavy
+    if index & 1 == 1 {
+      weight = kLight
+    }
+    current_.Insert(index, 1000+index, uint64(weight))
+    added += weight
+    index++
+  }
+
+  var cached_weight int = 0
+  for i := 0; i < index; i++ {
+    var weight int = kHeavy
+    if i & 1 == 1 {
+      weight = kLight
+    }
+    var r int = current_.Lookup(i)
+    if r >= 0 {
+      cached_weight += weight
+      ASSERT_EQ(1000+i, r)
+    }
+  }
+  ASSERT_LE(cached_weight, kCacheSize + kCacheSize/10)
+}
+
+func TestClockCache_Prune(t *testing.T) {
+  var current_ *CacheTest = ConstructClockCacheTest()
+
+  current_.Insert(1, 100, 1)
+  current_.Insert(2, 200, 1)
+
+  var handle CacheHandle = current_.cache_.Lookup(NewSlice(EncodeKey(1)))
+  current_.cache_.Prune()
+  current_.cache_.Release(handle)
+
+  ASSERT_EQ(100, current_.Lookup(1))
+  ASSERT_EQ(-1,  current_.Lookup(2))
+}
+
+func TestClockCache_TTL(t *testing.T) {
+  var current_ *CacheTest = ConstructClockCacheTest()
+
+  current_.InsertWithTTL(100, 101, 1, time.Millisecond)
+  current_.InsertWithTTL(200, 201, 1, time.Hour)
+  time.Sleep(10 * time.Millisecond)
+
+  ASSERT_EQ(-1, current_.Lookup(100))
+  ASSERT_EQ(201, current_.Lookup(200))
+  ASSERT_EQ(1, len(current_deleted_keys))
+  ASSERT_EQ(100, current_deleted_keys[0])
+  ASSERT_EQ(1, int(current_.cache_.TotalCharge()))
+}
+
+func TestClockCache_SetCapacity(t *testing.T) {
+  var current_ *CacheTest = ConstructClockCacheTest()
+
+  for i := 0; i < kCacheSize; i++ {
+    current_.Insert(i, 1000+i, 1)
+  }
+  var h CacheHandle = current_.cache_.Lookup(NewSlice(EncodeKey(0)))
+
+  current_.cache_.SetCapacity(kCacheSize / 10)
+  ASSERT_LE(int(current_.cache_.TotalCharge()), kCacheSize / 10 + kNumShards)
+  ASSERT_EQ(1000, current_.Lookup(0))
+  current_.cache_.Release(h)
+}
+
+func TestClockCache_Peek(t *testing.T) {
+  var current_ *CacheTest = ConstructClockCacheTest()
+
+  current_.Insert(100, 101, 1)
+  v, ok := current_.cache_.Peek(NewSlice(EncodeKey(100)))
+  if !ok || DecodeValue(v) != 101 {
+    panic("TestClockCache_Peek() error")
+  }
+  if _, ok = current_.cache_.Peek(NewSlice(EncodeKey(200))); ok {
+    panic("TestClockCache_Peek() error")
+  }
+  ASSERT_EQ(0, int(current_.cache_.Stats().Hits + current_.cache_.Stats().Misses))
+}
+
+func TestClockCache_ApplyToAllEntries(t *testing.T) {
+  var current_ *CacheTest = ConstructClockCacheTest()
+
+  for i := 0; i < 100; i++ {
+    current_.Insert(i, 1000+i, 1)
+  }
+  current_.Erase(50)
+
+  var count int = 0
+  current_.cache_.ApplyToAllEntries(func(key *Slice, value interface{}, charge uint64) {
+    ASSERT_EQ(1000 + DecodeKey(key), DecodeValue(value))
+    count++
+  })
+  ASSERT_EQ(99, count)
+}
+
+func TestClockCache_Priority(t *testing.T) {
+  var current_ *CacheTest = ConstructClockCacheTest()
+
+  current_.cache_.Release(current_.cache_.InsertWithPriority(
+      NewSlice(EncodeKey(100)), 101, 1, CachePriorityHigh, Deleter))
+  current_.cache_.Release(current_.cache_.InsertWithPriority(
+      NewSlice(EncodeKey(200)), 201, 1, CachePriorityLow, Deleter))
+  var visited = func(k int) int {
+    var c *ShardedClockCache = current_.cache_.(*ShardedClockCache)
+    var key *Slice = NewSlice(EncodeKey(k))
+    var hash uint32 = c.HashSlice(key)
+    return int(c.shard_[c.Shard(hash)].table_.Lookup(key, hash).visited)
+  }
+  ASSERT_EQ(1, visited(100))
+  ASSERT_EQ(0, visited(200))
+}
+
+func TestClockCache_PruneTo(t *testing.T) {
+  var current_ *CacheTest = ConstructClockCacheTest()
+
+  for i := 0; i < kCacheSize; i++ {
+    current_.Insert(i, 1000+i, 1)
+  }
+  var evictions uint64 = current_.cache_.Stats().Evictions
+  current_.cache_.PruneTo(kCacheSize / 2)
+  ASSERT_LE(int(current_.cache_.TotalCharge()), kCacheSize / 2)
+  ASSERT_EQ(int(evictions), int(current_.cache_.Stats().Evictions))
+}
+
+func TestClockCache_StrictCapacityLimit(t *testing.T) {
+  var cache Cache = NewClockCache(kNumShards)
+  cache.SetStrictCapacityLimit(true)
+  var pinned []CacheHandle
+  for k := 0; k < 4*kNumShards; k++ {
+    h, err := cache.TryInsert(NewSlice(EncodeKey(k)), k, 1, Deleter)
+    if err == nil {
+      pinned = append(pinned, h)
+    }
+  }
+  ASSERT_LE(int(cache.TotalCharge()), kNumShards)
+  ASSERT_EQ(len(pinned), int(cache.TotalCharge()))
+  for _, h := range pinned {
+    cache.Release(h)
+  }
+}
+
+func TestClockCache_ErasePrefix(t *testing.T) {
+  var current_ *CacheTest = ConstructClockCacheTest()
+
+  for j := 0; j < 10; j++ {
+    current_.Insert(j * 256 + 7, j, 1)
+    current_.Insert(j * 256 + 8, j, 1)
+  }
+  current_.cache_.ErasePrefix(NewSlice([]byte{7}))
+  ASSERT_EQ(10, len(current_deleted_keys))
+  ASSERT_EQ(10, int(current_.cache_.TotalCharge()))
+  for j := 0; j < 10; j++ {
+    ASSERT_EQ(-1, current_.Lookup(j * 256 + 7))
+    ASSERT_EQ(j, current_.Lookup(j * 256 + 8))
+  }
+}
+
+func TestClockCache_ConcurrentLookup(t *testing.T) {
+  var cache Cache = NewClockCache(kCacheSize)
+  var wg sync.WaitGroup
+  for g := 0; g < 8; g++ {
+    wg.Add(1)
+    go func(g int) {
+      defer wg.Done()
+      for i := 0; i < 2000; i++ {
+        var key *Slice = NewSlice(EncodeKey((i * 7 + g) % (2 * kCacheSize)))
+        var h CacheHandle = cache.Lookup(key)
+        if h == nil {
+          h = cache.Insert(key, i, 1, func(*Slice, interface{}) {})
+        }
+        cache.Release(h)
+      }
+    }(g)
+  }
+  wg.Wait()
+  ASSERT_LE(int(cache.TotalCharge()), kCacheSize + kNumShards)
+}
+
+func BenchmarkClockCache_ConcurrentLookup(b *testing.B) {
+  var cache Cache = NewClockCache(kCacheSize * kNumShards)
+  var keys []*Slice
+  for i := 0; i < kCacheSize; i++ {
+    keys = append(keys, NewSlice(EncodeKey(i)))
+    cache.Release(cache.Insert(keys[i], i, 1, func(*Slice, interface{}) {}))
+  }
+
+  b.ReportAllocs()
+  b.ResetTimer()
+  b.RunParallel(func(pb *testing.PB) {
+    var i int = 0
+    for pb.Next() {
+      cache.Release(cache.Lookup(keys[i % kCacheSize]))
+      i++
+    }
+  })
+}
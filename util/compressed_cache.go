@@ -0,0 +1,123 @@
+// Copyright (c) 2016 Hong Xiaodong. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+// A compressed second tier for the LRU cache.  Entries that the LRU cache
+// evicts to make room are compressed and kept in a larger tier instead of
+// being dropped; a Lookup() that misses the LRU cache falls through to
+// the tier, decompresses the value and moves it back up.  This trades CPU
+// for a much larger effective cache size.
+//
+// Only []byte values (e.g. blocks) without a TTL are kept, since those are
+// the only values the tier knows how to compress.  An entry's deleter runs
+// when it is evicted from the LRU cache, as without the tier; the copy
+// moved back up is a fresh []byte and is inserted without a deleter.
+
+package util
+
+import (
+  "bytes"
+  "compress/flate"
+  "io"
+  "sync"
+)
+
+// Options for the compressed second tier of an LRU cache (see
+// LRUCacheOptions.CompressedTier).
+type CompressedTierOptions struct {
+  // Capacity of the tier, charged by compressed size.
+  Capacity uint64
+
+  // Compress "src", appending the result to "dst".  Default: DEFLATE at
+  // its fastest level; plug in Snappy here where it is available.
+  Compress func(dst, src []byte) []byte
+
+  // Reverse Compress().  Must be set if Compress is.
+  Decompress func(src []byte) ([]byte, error)
+}
+
+// What the tier stores for an entry evicted from the LRU cache.  The
+// entry's deleter has run by the time it is in the tier, so it is not kept.
+type compressedEntry struct {
+  data    []byte
+  charge  uint64  // Charge of the uncompressed entry.
+  role    CacheEntryRole
+}
+
+type compressedTier struct {
+  cache_      *ShardedLRUCache
+  compress_   func(dst, src []byte) []byte
+  decompress_ func(src []byte) ([]byte, error)
+}
+
+func newCompressedTier(options *CompressedTierOptions) *compressedTier {
+  var tier *compressedTier = new(compressedTier)
+  tier.cache_ = ConstructShardedLRUCache(options.Capacity)
+  tier.compress_ = options.Compress
+  tier.decompress_ = options.Decompress
+  if tier.compress_ == nil {
+    tier.compress_ = flateCompress
+    tier.decompress_ = flateDecompress
+  }
+  return tier
+}
+
+// Compress an entry evicted from the LRU cache (see LRUCache.SetSpill()),
+// returning the function that keeps the compressed copy.  Values that are
+// not []byte, or that do not shrink, are dropped.
+func (c *compressedTier) Spill(key *Slice, value interface{}, charge uint64, role CacheEntryRole) func() {
+  src, ok := value.([]byte)
+  if !ok {
+    return nil
+  }
+  var data []byte = c.compress_(nil, src)
+  if len(data) >= len(src) {
+    return nil
+  }
+  var e = &compressedEntry{data, charge, role}
+  return func() {
+    c.cache_.Release(c.cache_.Insert(key, e, uint64(len(data)), noopDeleter))
+  }
+}
+
+// If the tier holds "key", return its decompressed value with the charge
+// and role it was inserted with.  The compressed copy stays in the tier.
+func (c *compressedTier) Get(key *Slice) ([]byte, uint64, CacheEntryRole, bool) {
+  var h CacheHandle = c.cache_.Lookup(key)
+  if h == nil {
+    return nil, 0, 0, false
+  }
+  var e *compressedEntry = h.Value().(*compressedEntry)
+  c.cache_.Release(h)
+  value, err := c.decompress_(e.data)
+  if err != nil {
+    return nil, 0, 0, false
+  }
+  return value, e.charge, e.role, true
+}
+
+func noopDeleter(key *Slice, value interface{}) {
+}
+
+var flate_writer_pool = sync.Pool{
+  New: func() interface{} {
+    w, _ := flate.NewWriter(nil, flate.BestSpeed)
+    return w
+  },
+}
+
+func flateCompress(dst, src []byte) []byte {
+  var buf *bytes.Buffer = bytes.NewBuffer(dst)
+  var w *flate.Writer = flate_writer_pool.Get().(*flate.Writer)
+  w.Reset(buf)
+  w.Write(src)
+  w.Close()
+  flate_writer_pool.Put(w)
+  return buf.Bytes()
+}
+
+func flateDecompress(src []byte) ([]byte, error) {
+  var r io.ReadCloser = flate.NewReader(bytes.NewReader(src))
+  defer r.Close()
+  return io.ReadAll(r)
+}
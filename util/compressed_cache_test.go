@@ -0,0 +1,242 @@
+// Copyright (c) 2016 Hong Xiaodong. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package util
+
+import (
+  "testing"
+  "bytes"
+  "encoding/binary"
+  "errors"
+  "fmt"
+)
+
+func compressedTestKey(k int) *Slice {
+  var result []byte = make([]byte, 4)
+  binary.LittleEndian.PutUint32(result, uint32(k))
+  return NewSlice(result)
+}
+
+// A highly compressible value that still differs per key.
+func compressedTestValue(k int) []byte {
+  return []byte(fmt.Sprintf("%08d", k) + string(bytes.Repeat([]byte{'x'}, 1000)))
+}
+
+func newCompressedTestCache(tier *CompressedTierOptions) *ShardedLRUCache {
+  var options LRUCacheOptions
+  options.Capacity = 2 * kNumShards  // Room for about two entries per shard.
+  options.CompressedTier = tier
+  return ConstructShardedLRUCacheWithOptions(options)
+}
+
+func TestCompressedTier_FallThrough(t *testing.T) {
+  var cache *ShardedLRUCache = newCompressedTestCache(&CompressedTierOptions{Capacity: 1 << 20})
+  var noop = func(*Slice, interface{}) {}
+
+  for k := 0; k < 100; k++ {
+    cache.Release(cache.Insert(compressedTestKey(k), compressedTestValue(k), 1, noop))
+  }
+  if cache.TotalCharge() > 2 * kNumShards {
+    t.Fatalf("first tier over capacity: %d", cache.TotalCharge())
+  }
+  var tier Cache = cache.CompressedTier()
+  if tier.TotalCharge() == 0 || tier.TotalCharge() >= 100 * 1000 {
+    t.Fatalf("unexpected compressed tier charge %d", tier.TotalCharge())
+  }
+
+  // Every entry is still found, and its value survives the round trip.
+  for k := 0; k < 100; k++ {
+    var h CacheHandle = cache.Lookup(compressedTestKey(k))
+    if h == nil {
+      t.Fatalf("key %d lost", k)
+    }
+    if !bytes.Equal(compressedTestValue(k), h.Value().([]byte)) {
+      t.Fatalf("key %d has the wrong value", k)
+    }
+    cache.Release(h)
+  }
+  // A lookup served by the tier is a hit, and moving the entry back up
+  // is not an insert.
+  var stats CacheStats = cache.Stats()
+  if stats.Hits != 100 || stats.Misses != 0 || stats.Inserts != 100 {
+    t.Fatalf("unexpected stats %+v", stats)
+  }
+}
+
+func TestCompressedTier_PromotionFails(t *testing.T) {
+  var cache *ShardedLRUCache = newCompressedTestCache(&CompressedTierOptions{Capacity: 1 << 20})
+  var noop = func(*Slice, interface{}) {}
+
+  for k := 0; k < 10; k++ {
+    cache.Release(cache.Insert(compressedTestKey(k), compressedTestValue(k), 1, noop))
+  }
+  cache.SetCapacity(0)  // Spills everything; nothing can move back up.
+
+  // The entry is served uncached, and the compressed copy is kept.
+  for round := 0; round < 2; round++ {
+    var h CacheHandle = cache.Lookup(compressedTestKey(3))
+    if h == nil || !bytes.Equal(compressedTestValue(3), h.Value().([]byte)) {
+      t.Fatalf("key 3 lost in round %d", round)
+    }
+    cache.Release(h)
+  }
+}
+
+func TestCompressedTier_Erase(t *testing.T) {
+  var cache *ShardedLRUCache = newCompressedTestCache(&CompressedTierOptions{Capacity: 1 << 20})
+  var noop = func(*Slice, interface{}) {}
+
+  for k := 0; k < 100; k++ {
+    cache.Release(cache.Insert(compressedTestKey(k), compressedTestValue(k), 1, noop))
+  }
+  cache.Erase(compressedTestKey(0))
+  if h := cache.Lookup(compressedTestKey(0)); h != nil {
+    t.Fatalf("erased key found")
+  }
+
+  // A new insert makes the compressed copy stale.
+  cache.Release(cache.Insert(compressedTestKey(1), []byte("new"), 1, noop))
+  cache.PruneTo(0)
+  if h := cache.Lookup(compressedTestKey(1)); h != nil {
+    t.Fatalf("stale value of key 1 found")
+  }
+
+  cache.Prune()
+  if cache.CompressedTier().TotalCharge() != 0 {
+    t.Fatalf("Prune left %d in the compressed tier", cache.CompressedTier().TotalCharge())
+  }
+}
+
+func TestCompressedTier_DeleterOnce(t *testing.T) {
+  var cache *ShardedLRUCache = newCompressedTestCache(&CompressedTierOptions{Capacity: 1 << 20})
+  var deleted = make(map[string]int)
+  var deleter = func(key *Slice, value interface{}) {
+    deleted[key.ToString()]++
+  }
+
+  for k := 0; k < 100; k++ {
+    cache.Release(cache.Insert(compressedTestKey(k), compressedTestValue(k), 1, deleter))
+  }
+  // Move every entry back up through the tier, and out again.
+  for round := 0; round < 2; round++ {
+    for k := 0; k < 100; k++ {
+      var h CacheHandle = cache.Lookup(compressedTestKey(k))
+      if h == nil {
+        t.Fatalf("key %d lost", k)
+      }
+      cache.Release(h)
+    }
+  }
+  cache.Prune()
+
+  for k := 0; k < 100; k++ {
+    if n := deleted[compressedTestKey(k).ToString()]; n != 1 {
+      t.Fatalf("deleter of key %d ran %d times", k, n)
+    }
+  }
+}
+
+func TestCompressedTier_KeepsNewerInsert(t *testing.T) {
+  var cache *ShardedLRUCache = newCompressedTestCache(&CompressedTierOptions{Capacity: 1 << 20})
+  var noop = func(*Slice, interface{}) {}
+
+  for k := 0; k < 100; k++ {
+    cache.Release(cache.Insert(compressedTestKey(k), compressedTestValue(k), 1, noop))
+  }
+  // Emulate an insert racing with the fall-through: the reinsert of the
+  // compressed copy must not replace the newer entry.
+  var key *Slice = compressedTestKey(0)
+  var hash uint32 = cache.HashSlice(key)
+  var shard *LRUCache = cache.shard_[cache.Shard(hash)]
+  if shard.Lookup(key, hash) != nil {  // The miss that leads to the promotion.
+    t.Fatalf("key 0 not evicted")
+  }
+  shard.Release(shard.Insert(key, hash, []byte("new"), 1, noop))
+  var h CacheHandle = shard.InsertEntry(key, hash, compressedTestValue(0), 1, noopDeleter,
+                                        &insertOptions{promote: true})
+  if string(h.Value().([]byte)) != "new" {
+    t.Fatalf("reinsert replaced a newer entry")
+  }
+  shard.Release(h)
+  if stats := shard.Stats(); stats.Hits != 1 || stats.Misses != 0 {
+    t.Fatalf("unexpected stats %+v", stats)
+  }
+}
+
+func TestCompressedTier_StaleSpill(t *testing.T) {
+  var cache *LRUCache = ConstructLRUCache()
+  cache.SetCapacity(1)
+  var noop = func(*Slice, interface{}) {}
+  var insert = func(k int, value int) {
+    var key *Slice = compressedTestKey(k)
+    cache.Release(cache.Insert(key, Hash(key.data(), 0), value, 1, noop))
+  }
+  var stored []int
+  cache.SetSpill(func(key *Slice, value interface{}, charge uint64, role CacheEntryRole) func() {
+    if value.(int) == 100 {
+      // Key 0 is written again while its old value is being spilled.
+      insert(0, 200)
+    }
+    return func() { stored = append(stored, value.(int)) }
+  })
+
+  insert(0, 100)
+  insert(1, 101)  // Evicts key 0, whose spill is then stale.
+  if len(stored) != 0 {
+    t.Fatalf("stale spill stored: %v", stored)
+  }
+  insert(2, 102)  // Evicts key 1 and the newer value of key 0.
+  if len(stored) != 2 || stored[0] + stored[1] != 301 {
+    t.Fatalf("unexpected spilled entries %v", stored)
+  }
+}
+
+func TestCompressedTier_OnlyBytes(t *testing.T) {
+  var cache *ShardedLRUCache = newCompressedTestCache(&CompressedTierOptions{Capacity: 1 << 20})
+  var noop = func(*Slice, interface{}) {}
+
+  for k := 0; k < 100; k++ {
+    cache.Release(cache.Insert(compressedTestKey(k), k, 1, noop))
+  }
+  if cache.CompressedTier().TotalCharge() != 0 {
+    t.Fatalf("non-[]byte values were kept")
+  }
+}
+
+func TestCompressedTier_CustomCodec(t *testing.T) {
+  var compressed, decompressed int
+  var options CompressedTierOptions
+  options.Capacity = 1 << 20
+  // Run-length encode a value of a single repeated byte; refuse anything else.
+  options.Compress = func(dst, src []byte) []byte {
+    compressed++
+    return append(dst, src[0], byte(len(src)))
+  }
+  options.Decompress = func(src []byte) ([]byte, error) {
+    decompressed++
+    if len(src) != 2 {
+      return nil, errors.New("corrupt")
+    }
+    return bytes.Repeat(src[:1], int(src[1])), nil
+  }
+  var cache *ShardedLRUCache = newCompressedTestCache(&options)
+  var noop = func(*Slice, interface{}) {}
+
+  for k := 0; k < 100; k++ {
+    cache.Release(cache.Insert(compressedTestKey(k), bytes.Repeat([]byte{byte(k)}, 10), 1, noop))
+  }
+  if compressed == 0 {
+    t.Fatalf("custom compressor not used")
+  }
+  for k := 0; k < 100; k++ {
+    var h CacheHandle = cache.Lookup(compressedTestKey(k))
+    if h == nil || !bytes.Equal(bytes.Repeat([]byte{byte(k)}, 10), h.Value().([]byte)) {
+      t.Fatalf("key %d lost", k)
+    }
+    cache.Release(h)
+  }
+  if decompressed == 0 {
+    t.Fatalf("custom decompressor not used")
+  }
+}
@@ -1,7 +1,16 @@
 #!/bin/bash
 
 echo "test cache"
-go test cache_test.go cache.go slice.go hash.go assert.go
+go test cache_test.go cache.go compressed_cache.go clock_cache.go slice.go hash.go assert.go
+
+echo "test clock cache"
+go test -run TestClockCache clock_cache_test.go cache_test.go clock_cache.go cache.go compressed_cache.go slice.go hash.go assert.go
+
+echo "test typed cache"
+go test typed_cache_test.go typed_cache.go cache.go compressed_cache.go clock_cache.go slice.go hash.go assert.go
+
+echo "test compressed cache"
+go test compressed_cache_test.go compressed_cache.go cache.go clock_cache.go slice.go hash.go assert.go
 
 echo "test crc32c"
 go test crc32c_test.go crc32c.go
@@ -9,6 +18,9 @@ go test crc32c_test.go crc32c.go
 echo "test slice"
 go test slice_test.go slice.go
 
+echo "test slice builder"
+go test slice_builder_test.go slice_builder.go slice.go
+
 echo "test hash"
 go test hash_test.go hash.go
 
@@ -16,6 +16,9 @@ package util
 
 import (
   "bytes"
+  "encoding/hex"
+  "fmt"
+  "strings"
 )
 
 type Slice struct {
@@ -29,59 +32,154 @@ func NewSlice(data []byte) *Slice {
 }
 
 // Return data
-func (s *Slice) data() []byte {
+func (s *Slice) Data() []byte {
   return s.data_
 }
 
 // Return the length (in bytes) of the referenced data
-func (s *Slice) size() uint64 {
+func (s *Slice) Size() uint64 {
   return s.size_
 }
 
 // Return true iff the length of the referenced data is zero
-func (s *Slice) empty() bool {
+func (s *Slice) Empty() bool {
   return s.size_ == 0
 }
 
 // Return the ith byte in the referenced data.
-// REQUIRES: n < size()
-func (s *Slice) at(n uint64) byte {
-  if (n >= s.size()) {
-    panic("Slice at() error")
+// REQUIRES: n < Size()
+func (s *Slice) At(n uint64) byte {
+  if (n >= s.Size()) {
+    panic("Slice At() error")
   }
   return s.data_[n]
 }
 
 // Change this slice to refer to an empty array
-func (s *Slice) clear() {
+func (s *Slice) Clear() {
   s.data_ = nil
   s.size_ = 0
 }
 
 // Drop the first "n" bytes from this slice.
-func (s *Slice) remove_prefix(n uint64) {
-  if (n > s.size()) {
-    panic("Slice remove_prefix() error")
+func (s *Slice) RemovePrefix(n uint64) {
+  if (n > s.Size()) {
+    panic("Slice RemovePrefix() error")
   }
   s.data_ = s.data_[n:]
   s.size_ -= n
 }
 
+// Drop the last "n" bytes from this slice.
+func (s *Slice) RemoveSuffix(n uint64) {
+  if (n > s.Size()) {
+    panic("Slice RemoveSuffix() error")
+  }
+  s.size_ -= n
+  s.data_ = s.data_[:s.size_]
+}
+
+// Keep only the first "n" bytes of this slice.
+func (s *Slice) Truncate(n uint64) {
+  if (n > s.Size()) {
+    panic("Slice Truncate() error")
+  }
+  s.data_ = s.data_[:n]
+  s.size_ = n
+}
+
+// Return a slice referring to bytes [start, end) of this slice.  The
+// result shares the referenced data; nothing is copied.
+// REQUIRES: start <= end <= Size()
+func (s *Slice) Range(start, end uint64) *Slice {
+  if (start > end || end > s.Size()) {
+    panic("Slice Range() error")
+  }
+  return &Slice{s.data_[start:end], end - start}
+}
+
+// Return a slice referring to the first "n" bytes of this slice, sharing
+// the referenced data.
+// REQUIRES: n <= Size()
+func (s *Slice) Prefix(n uint64) *Slice {
+  return s.Range(0, n)
+}
+
 // Return a string that contains the copy of the referenced data.
 func (s *Slice) ToString() string {
   return string(s.data_)
 }
 
+// Implement fmt.Stringer: the referenced data with non-printable bytes
+// escaped, so binary keys print readably.
+func (s *Slice) String() string {
+  return s.EscapedString()
+}
+
+// Return the referenced data with every byte outside printable ASCII
+// written as "\xNN", like leveldb's EscapeString().
+func (s *Slice) EscapedString() string {
+  var buf strings.Builder
+  for _, c := range s.data_ {
+    if c >= ' ' && c <= '~' {
+      buf.WriteByte(c)
+    } else {
+      fmt.Fprintf(&buf, "\\x%02x", c)
+    }
+  }
+  return buf.String()
+}
+
+// Return the referenced data as upper-case hex, two digits per byte.
+func (s *Slice) Hex() string {
+  const kDigits = "0123456789ABCDEF"
+  var buf []byte = make([]byte, 0, 2 * len(s.data_))
+  for _, c := range s.data_ {
+    buf = append(buf, kDigits[c >> 4], kDigits[c & 0xf])
+  }
+  return string(buf)
+}
+
+// Implement encoding.BinaryMarshaler: a copy of the referenced data.
+func (s *Slice) MarshalBinary() ([]byte, error) {
+  return append([]byte(nil), s.data_ ...), nil
+}
+
+// Implement encoding.BinaryUnmarshaler: make this slice refer to a copy
+// of "data".
+func (s *Slice) UnmarshalBinary(data []byte) error {
+  s.data_ = append([]byte(nil), data ...)
+  s.size_ = uint64(len(data))
+  return nil
+}
+
+// Implement encoding.TextMarshaler: the referenced data as hex (see
+// Hex()), which round-trips any key through JSON and other text formats.
+func (s *Slice) MarshalText() ([]byte, error) {
+  return []byte(s.Hex()), nil
+}
+
+// Implement encoding.TextUnmarshaler: the reverse of MarshalText().
+func (s *Slice) UnmarshalText(text []byte) error {
+  var data []byte = make([]byte, hex.DecodedLen(len(text)))
+  if _, err := hex.Decode(data, text); err != nil {
+    return err
+  }
+  s.data_ = data
+  s.size_ = uint64(len(data))
+  return nil
+}
+
 // Three-way comparison.  Returns value:
 //   <  0 iff "*this" <  "b",
 //   == 0 iff "*this" == "b",
 //   >  0 iff "*this" >  "b"
-func (s *Slice) compare(b *Slice) int {
+func (s *Slice) Compare(b *Slice) int {
   return bytes.Compare(s.data_, b.data_)
 }
 
 // Return true iff "x" is a prefix of "*this"
-func (s *Slice) starts_with(x *Slice) bool {
+func (s *Slice) StartsWith(x *Slice) bool {
   return bytes.HasPrefix(s.data_, x.data_)
 }
 
@@ -93,3 +191,14 @@ func (s *Slice) NotEqual(b *Slice) bool {
   return !s.Equal(b)
 }
 
+// Unexported aliases of the accessors above, kept for the code in this
+// package that predates them.
+
+func (s *Slice) data() []byte              { return s.Data() }
+func (s *Slice) size() uint64              { return s.Size() }
+func (s *Slice) empty() bool               { return s.Empty() }
+func (s *Slice) at(n uint64) byte          { return s.At(n) }
+func (s *Slice) clear()                    { s.Clear() }
+func (s *Slice) remove_prefix(n uint64)    { s.RemovePrefix(n) }
+func (s *Slice) compare(b *Slice) int      { return s.Compare(b) }
+func (s *Slice) starts_with(x *Slice) bool { return s.StartsWith(x) }
@@ -0,0 +1,94 @@
+// Copyright (c) 2016 Hong Xiaodong. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+// SliceBuilder accumulates bytes, e.g. the parts of an internal key or a
+// block entry, and yields them as a Slice.  Its buffer comes from a pool
+// shared by all builders, so building many short-lived keys does not
+// allocate a new []byte for each one.
+//
+// The Slice returned by Slice() refers to the builder's buffer: it is only
+// valid until the next Append*(), Reset() or Release().
+
+package util
+
+import (
+  "encoding/binary"
+  "sync"
+)
+
+// Buffers larger than this are not returned to the pool, so one huge
+// entry does not pin its memory forever.
+const kMaxPooledBuilderSize = 64 << 10
+
+var slice_builder_pool = sync.Pool{
+  New: func() interface{} {
+    var buf []byte = make([]byte, 0, 256)
+    return &buf
+  },
+}
+
+type SliceBuilder struct {
+  buf_ *[]byte
+}
+
+// Create a builder with an empty buffer taken from the pool.  Call
+// Release() when done with it.
+func NewSliceBuilder() *SliceBuilder {
+  var b *SliceBuilder = new(SliceBuilder)
+  b.buf_ = slice_builder_pool.Get().(*[]byte)
+  *b.buf_ = (*b.buf_)[:0]
+  return b
+}
+
+// Append "data".
+func (b *SliceBuilder) Append(data []byte) {
+  *b.buf_ = append(*b.buf_, data ...)
+}
+
+// Append the data referenced by "s".
+func (b *SliceBuilder) AppendSlice(s *Slice) {
+  b.Append(s.Data())
+}
+
+// Append "v" as a varint (at most 10 bytes; 5 for a value that fits in
+// 32 bits).
+func (b *SliceBuilder) AppendVarint(v uint64) {
+  *b.buf_ = binary.AppendUvarint(*b.buf_, v)
+}
+
+// Append "v" as 4 little-endian bytes.
+func (b *SliceBuilder) AppendFixed32(v uint32) {
+  *b.buf_ = binary.LittleEndian.AppendUint32(*b.buf_, v)
+}
+
+// Append "v" as 8 little-endian bytes.
+func (b *SliceBuilder) AppendFixed64(v uint64) {
+  *b.buf_ = binary.LittleEndian.AppendUint64(*b.buf_, v)
+}
+
+// Return the number of bytes appended so far.
+func (b *SliceBuilder) Size() uint64 {
+  return uint64(len(*b.buf_))
+}
+
+// Return a slice referring to the bytes appended so far.  It shares the
+// builder's buffer; copy it (e.g. with ToString()) to keep it past the
+// next change to the builder.
+func (b *SliceBuilder) Slice() *Slice {
+  return NewSlice(*b.buf_)
+}
+
+// Discard the bytes appended so far, keeping the buffer.
+func (b *SliceBuilder) Reset() {
+  *b.buf_ = (*b.buf_)[:0]
+}
+
+// Return the buffer to the pool.  Neither the builder nor any slice it
+// returned may be used afterwards.
+func (b *SliceBuilder) Release() {
+  if cap(*b.buf_) <= kMaxPooledBuilderSize {
+    slice_builder_pool.Put(b.buf_)
+  }
+  b.buf_ = nil
+}
@@ -0,0 +1,68 @@
+// Copyright (c) 2016 Hong Xiaodong. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package util
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func TestSliceBuilder(t *testing.T) {
+  var b = NewSliceBuilder()
+  defer b.Release()
+
+  // An internal key: user key, then the sequence/type tag.
+  b.AppendSlice(NewSlice([]byte("userkey")))
+  b.AppendFixed64(7 << 8 | 1)
+  if b.Size() != 15 {
+    t.Fatalf("Size error: %d", b.Size())
+  }
+  var s = b.Slice()
+  if s.Prefix(7).ToString() != "userkey" {
+    t.Fatalf("AppendSlice error")
+  }
+  if binary.LittleEndian.Uint64(s.Range(7, 15).Data()) != 7 << 8 | 1 {
+    t.Fatalf("AppendFixed64 error")
+  }
+
+  // A length-prefixed value.
+  b.Reset()
+  b.AppendVarint(300)
+  b.Append([]byte("v"))
+  b.AppendFixed32(0xdeadbeef)
+  s = b.Slice()
+  v, n := binary.Uvarint(s.Data())
+  if v != 300 || n != 2 {
+    t.Fatalf("AppendVarint error")
+  }
+  if s.At(2) != 'v' || binary.LittleEndian.Uint32(s.Range(3, 7).Data()) != 0xdeadbeef {
+    t.Fatalf("Append/AppendFixed32 error")
+  }
+}
+
+func TestSliceBuilder_Reuse(t *testing.T) {
+  var b = NewSliceBuilder()
+  b.Append([]byte("leftover"))
+  b.Release()
+
+  // A builder from the pool always starts out empty.
+  var c = NewSliceBuilder()
+  defer c.Release()
+  if c.Size() != 0 || !c.Slice().Empty() {
+    t.Fatalf("pooled builder not empty")
+  }
+}
+
+func BenchmarkSliceBuilder_InternalKey(b *testing.B) {
+  var user_key = NewSlice([]byte("a moderately long user key"))
+
+  b.ReportAllocs()
+  for i := 0; i < b.N; i++ {
+    var builder = NewSliceBuilder()
+    builder.AppendSlice(user_key)
+    builder.AppendFixed64(uint64(i) << 8 | 1)
+    builder.Release()
+  }
+}
@@ -5,6 +5,8 @@
 package util
 
 import (
+	"encoding/json"
+	"fmt"
 	"testing"
 )
 
@@ -67,3 +69,137 @@ func TestSlice(t *testing.T) {
   }
 }
 
+
+func TestSlice_ExportedAccessors(t *testing.T) {
+  var s = NewSlice([]byte("HelloWorld"))
+
+  if s.Size() != 10 || s.Empty() || s.At(5) != 'W' {
+    t.Fatalf("accessor error")
+  }
+
+  if s.Compare(NewSlice([]byte("Hello"))) <= 0 || !s.StartsWith(NewSlice([]byte("Hello"))) {
+    t.Fatalf("Compare/StartsWith error")
+  }
+
+  s.RemovePrefix(5)
+  if string(s.Data()) != "World" || s.Size() != 5 {
+    t.Fatalf("RemovePrefix error")
+  }
+
+  s.Clear()
+  if !s.Empty() || s.Data() != nil {
+    t.Fatalf("Clear error")
+  }
+}
+
+func TestSlice_Formatting(t *testing.T) {
+  var s = NewSlice([]byte("key\x00\x01\xff~"))
+
+  if s.EscapedString() != "key\\x00\\x01\\xff~" {
+    t.Fatalf("EscapedString error: %s", s.EscapedString())
+  }
+
+  if s.String() != s.EscapedString() || fmt.Sprint(s) != s.EscapedString() {
+    t.Fatalf("String error: %v", s)
+  }
+
+  if s.Hex() != "6B65790001FF7E" {
+    t.Fatalf("Hex error: %s", s.Hex())
+  }
+
+  if NewSlice(nil).Hex() != "" || NewSlice(nil).String() != "" {
+    t.Fatalf("empty slice formatting error")
+  }
+}
+
+func TestSlice_RemoveSuffixAndTruncate(t *testing.T) {
+  // An internal key: user key followed by an 8-byte sequence/type tag.
+  var s = NewSlice([]byte("userkey\x01\x00\x00\x00\x00\x00\x00\x07"))
+
+  s.RemoveSuffix(8)
+  if s.ToString() != "userkey" || s.Size() != 7 {
+    t.Fatalf("RemoveSuffix error")
+  }
+
+  s.Truncate(4)
+  if s.ToString() != "user" || s.Size() != 4 {
+    t.Fatalf("Truncate error")
+  }
+
+  s.RemoveSuffix(4)
+  if !s.Empty() {
+    t.Fatalf("RemoveSuffix error")
+  }
+
+  defer func() {
+    if recover() == nil {
+      t.Fatalf("Truncate past the end did not panic")
+    }
+  }()
+  s.Truncate(1)
+}
+
+func TestSlice_Marshaling(t *testing.T) {
+  var s = NewSlice([]byte("key\x00\xff"))
+
+  data, err := s.MarshalBinary()
+  if err != nil || string(data) != "key\x00\xff" {
+    t.Fatalf("MarshalBinary error")
+  }
+  data[0] = 'K'  // Must be a copy.
+  if s.ToString() != "key\x00\xff" {
+    t.Fatalf("MarshalBinary did not copy")
+  }
+
+  var b Slice
+  if err := b.UnmarshalBinary([]byte("key\x00\xff")); err != nil || !b.Equal(s) {
+    t.Fatalf("UnmarshalBinary error")
+  }
+
+  var config = map[string]*Slice{"start": s}
+  encoded, err := json.Marshal(config)
+  if err != nil || string(encoded) != `{"start":"6B657900FF"}` {
+    t.Fatalf("MarshalText error: %s", encoded)
+  }
+  var decoded map[string]*Slice
+  if err := json.Unmarshal(encoded, &decoded); err != nil || !decoded["start"].Equal(s) {
+    t.Fatalf("UnmarshalText error: %v", err)
+  }
+
+  var c Slice
+  if c.UnmarshalText([]byte("not hex")) == nil {
+    t.Fatalf("UnmarshalText accepted bad input")
+  }
+}
+
+func TestSlice_RangeAndPrefix(t *testing.T) {
+  var buf = []byte("userkey\x01\x02")
+  var s = NewSlice(buf)
+
+  var user = s.Prefix(7)
+  if user.ToString() != "userkey" || user.Size() != 7 {
+    t.Fatalf("Prefix error")
+  }
+
+  var tag = s.Range(7, 9)
+  if tag.ToString() != "\x01\x02" || tag.Size() != 2 {
+    t.Fatalf("Range error")
+  }
+
+  // Sub-slices share the backing bytes.
+  buf[0] = 'U'
+  if user.At(0) != 'U' {
+    t.Fatalf("Prefix copied the data")
+  }
+
+  if !s.Range(3, 3).Empty() {
+    t.Fatalf("empty Range error")
+  }
+
+  defer func() {
+    if recover() == nil {
+      t.Fatalf("Range past the end did not panic")
+    }
+  }()
+  s.Range(5, 10)
+}
@@ -0,0 +1,101 @@
+// Copyright (c) 2016 Hong Xiaodong. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+// TypedCache is a type-safe wrapper over a Cache.  Keys of type K are
+// turned into cache keys by a caller-supplied encoder, and values of type
+// V are stored and returned without the caller boxing them into
+// interface{} and casting on every Lookup()/Value().
+//
+// Charge-based eviction and deleters behave exactly as in the underlying
+// Cache.  All entries of the underlying cache that are reached through a
+// TypedCache must have been inserted through a TypedCache with the same K
+// and V; sharing one Cache between several wrappers is fine as long as
+// their encoded keys do not collide (e.g. prefix them with Cache.NewId()).
+
+package util
+
+// Deleter called with the original key and value when an entry inserted
+// through a TypedCache is no longer needed.
+type TypedCacheDeleter[K comparable, V any] func(key K, value V)
+
+type TypedCache[K comparable, V any] struct {
+  cache_  Cache
+  encode_ func(K) []byte
+}
+
+// What is actually stored as the value in the underlying cache.
+type typedCacheEntry[K comparable, V any] struct {
+  key     K
+  value   V
+  deleter TypedCacheDeleter[K, V]
+}
+
+// Charge AutoCharge inserts by the caller's value, not the wrapper.
+func (e *typedCacheEntry[K, V]) unwrap() interface{} {
+  return e.value
+}
+
+func deleteTypedCacheEntry[K comparable, V any](key *Slice, value interface{}) {
+  var e *typedCacheEntry[K, V] = value.(*typedCacheEntry[K, V])
+  if e.deleter != nil {
+    e.deleter(e.key, e.value)
+  }
+}
+
+// Create a TypedCache over "cache".  "encode" maps a key to the bytes
+// used as the key in "cache"; distinct keys must encode differently.
+func NewTypedCache[K comparable, V any](cache Cache, encode func(K) []byte) *TypedCache[K, V] {
+  return &TypedCache[K, V]{cache, encode}
+}
+
+// Return the underlying cache.
+func (c *TypedCache[K, V]) Cache() Cache {
+  return c.cache_
+}
+
+// Insert a mapping from key->value and assign it the specified charge,
+// which may be AutoCharge.  The caller must Release() the returned handle.
+// "deleter" may be nil.
+func (c *TypedCache[K, V]) Insert(key K, value V, charge uint64, deleter TypedCacheDeleter[K, V]) CacheHandle {
+  var e = &typedCacheEntry[K, V]{key, value, deleter}
+  return c.cache_.Insert(NewSlice(c.encode_(key)), e, charge, deleteTypedCacheEntry[K, V])
+}
+
+// If the cache has no mapping for "key", returns (nil, false).  Else
+// returns a handle that the caller must Release().
+func (c *TypedCache[K, V]) Lookup(key K) (CacheHandle, bool) {
+  var handle CacheHandle = c.cache_.Lookup(NewSlice(c.encode_(key)))
+  if handle == nil {
+    return nil, false
+  }
+  return handle, true
+}
+
+// Return the value encapsulated in a handle returned by Insert() or a
+// successful Lookup().
+func (c *TypedCache[K, V]) Value(handle CacheHandle) V {
+  return c.cache_.Value(handle).(*typedCacheEntry[K, V]).value
+}
+
+// Release a mapping returned by a previous Insert() or Lookup().
+func (c *TypedCache[K, V]) Release(handle CacheHandle) {
+  c.cache_.Release(handle)
+}
+
+// Look up "key" and return a copy of its value without keeping a handle.
+func (c *TypedCache[K, V]) Get(key K) (V, bool) {
+  handle, ok := c.Lookup(key)
+  if !ok {
+    var zero V
+    return zero, false
+  }
+  var value V = c.Value(handle)
+  c.Release(handle)
+  return value, true
+}
+
+// If the cache contains entry for key, erase it.
+func (c *TypedCache[K, V]) Erase(key K) {
+  c.cache_.Erase(NewSlice(c.encode_(key)))
+}
@@ -0,0 +1,129 @@
+// Copyright (c) 2016 Hong Xiaodong. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package util
+
+import (
+  "testing"
+  "encoding/binary"
+)
+
+const kTypedCacheSize = 1000
+
+type typedCacheValue struct {
+  name string
+  size int
+}
+
+func encodeStringKey(k string) []byte {
+  return []byte(k)
+}
+
+func encodeIntKey(k int) []byte {
+  var result []byte = make([]byte, 4)
+  binary.LittleEndian.PutUint32(result, uint32(k))
+  return result
+}
+
+func TestTypedCache_HitAndMiss(t *testing.T) {
+  var c = NewTypedCache[string, *typedCacheValue](NewLRUCache(kTypedCacheSize), encodeStringKey)
+
+  if _, ok := c.Get("a"); ok {
+    t.Fatalf("Get on empty cache error")
+  }
+
+  c.Release(c.Insert("a", &typedCacheValue{"a", 1}, 1, nil))
+  c.Release(c.Insert("b", &typedCacheValue{"b", 2}, 1, nil))
+
+  handle, ok := c.Lookup("a")
+  if !ok {
+    t.Fatalf("Lookup error")
+  }
+  if v := c.Value(handle); v.name != "a" || v.size != 1 {
+    t.Fatalf("Value error")
+  }
+  c.Release(handle)
+
+  if v, ok := c.Get("b"); !ok || v.size != 2 {
+    t.Fatalf("Get error")
+  }
+  if _, ok := c.Lookup("c"); ok {
+    t.Fatalf("Lookup miss error")
+  }
+}
+
+func TestTypedCache_Deleter(t *testing.T) {
+  var c = NewTypedCache[int, string](NewLRUCache(kTypedCacheSize), encodeIntKey)
+  var deleted_keys []int
+  var deleted_values []string
+  var deleter = func(k int, v string) {
+    deleted_keys = append(deleted_keys, k)
+    deleted_values = append(deleted_values, v)
+  }
+
+  c.Release(c.Insert(100, "101", 1, deleter))
+  c.Release(c.Insert(100, "102", 1, deleter))
+  ASSERT_EQ(1, len(deleted_keys))
+  ASSERT_EQ(100, deleted_keys[0])
+  if deleted_values[0] != "101" {
+    t.Fatalf("Deleter value error")
+  }
+
+  c.Erase(100)
+  ASSERT_EQ(2, len(deleted_keys))
+  if deleted_values[1] != "102" {
+    t.Fatalf("Deleter value error")
+  }
+  if _, ok := c.Get(100); ok {
+    t.Fatalf("Erase error")
+  }
+}
+
+func TestTypedCache_ChargeEviction(t *testing.T) {
+  var c = NewTypedCache[int, int](NewLRUCache(kTypedCacheSize), encodeIntKey)
+  var deleted int = 0
+  var deleter = func(k int, v int) {
+    deleted++
+  }
+
+  for i := 0; i < kTypedCacheSize + 100; i++ {
+    c.Release(c.Insert(i, 1000+i, 1, deleter))
+  }
+  ASSERT_LE(int(c.Cache().TotalCharge()), kTypedCacheSize + kNumShards)
+  if deleted == 0 {
+    t.Fatalf("Eviction error")
+  }
+
+  var found int = 0
+  for i := 0; i < kTypedCacheSize + 100; i++ {
+    if v, ok := c.Get(i); ok {
+      ASSERT_EQ(1000+i, v)
+      found++
+    }
+  }
+  ASSERT_EQ(kTypedCacheSize + 100 - deleted, found)
+}
+
+type typedSizedValue []byte
+
+func (v typedSizedValue) Charge() uint64 {
+  return uint64(len(v))
+}
+
+func TestTypedCache_AutoCharge(t *testing.T) {
+  // A value implementing Sizer is charged by its own size.
+  var c = NewTypedCache[int, typedSizedValue](NewLRUCache(kTypedCacheSize), encodeIntKey)
+  c.Release(c.Insert(1, make(typedSizedValue, 100), AutoCharge, nil))
+  ASSERT_EQ(100, int(c.Cache().TotalCharge()))
+
+  // Other values are passed to LRUCacheOptions.Sizer unwrapped.
+  var options LRUCacheOptions
+  options.Capacity = kTypedCacheSize
+  options.Sizer = func(value interface{}) uint64 {
+    return uint64(len(value.(string)))
+  }
+  var d = NewTypedCache[int, string](NewLRUCacheWithOptions(options), encodeIntKey)
+  d.Release(d.Insert(1, "hello", AutoCharge, nil))
+  ASSERT_EQ(5, int(d.Cache().TotalCharge()))
+}